@@ -0,0 +1,534 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// writes files, directories and symlinks to an archive as a stream
+type archiveWriter interface {
+	// adds an entry with the given name to the archive. for regular files, the
+	// contents are read from the reader. for symlinks, the link's destination
+	// is given instead. directories have no contents. if reading the contents
+	// fails, an *archiveReadError is returned and the archive is left in a
+	// consistent state so more entries can still be written.
+	WriteEntry(name string, file os.FileInfo, linkDest string, contents io.Reader) error
+
+	// flushes everything written so far through to the underlying writer
+	Flush() error
+
+	// finishes the archive. this doesn't close the underlying writer.
+	Close() error
+}
+
+// a format directories can be downloaded as
+type archiveFormat struct {
+	Name      string
+	Extension string
+	MIMEType  string
+	NewWriter func(w io.Writer) (archiveWriter, error)
+}
+
+// every archive format we support, in order of preference
+var archiveFormats = []archiveFormat{
+	{"zip", ".zip", "application/zip", newZipArchiveWriter},
+	{"tar", ".tar", "application/x-tar", newTarArchiveWriter},
+	{"tar.gz", ".tar.gz", "application/gzip", newTarGzipArchiveWriter},
+	{"tar.zst", ".tar.zst", "application/zstd", newTarZstdArchiveWriter},
+}
+
+// picks the archive format for a request. the `format` query parameter takes
+// precedence, followed by the first supported type in the Accept header,
+// falling back to ZIP. returns false if a format was explicitly requested that
+// we don't support.
+func getArchiveFormat(r *http.Request) (archiveFormat, bool) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, format := range archiveFormats {
+			if format.Name == name {
+				return format, true
+			}
+		}
+
+		return archiveFormat{}, false
+	}
+
+	// NOTE: we don't bother with quality values since nobody sends more than
+	// one archive type anyway.
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mimeType := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		for _, format := range archiveFormats {
+			if format.MIMEType == mimeType {
+				return format, true
+			}
+		}
+	}
+
+	return archiveFormats[0], true
+}
+
+// returned when the contents of an entry couldn't be read in their entirety.
+// unlike other errors, these leave the archive usable.
+type archiveReadError struct {
+	Written int64 // how many bytes were written before the error
+	Err     error
+}
+
+func (e *archiveReadError) Error() string {
+	return fmt.Sprintf("read failed after %d bytes: %s", e.Written, e.Err)
+}
+
+// wraps a reader, remembering the first error it returns so we can tell read
+// errors apart from write errors after a copy fails.
+type errorTrackingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (t *errorTrackingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// copies an entry's contents into an archive, returning an *archiveReadError
+// if it was the contents that failed rather than the archive.
+func copyEntryContents(dst io.Writer, src io.Reader) (int64, error) {
+	tracker := &errorTrackingReader{r: src}
+	written, err := io.Copy(dst, tracker)
+	if tracker.err != nil {
+		return written, &archiveReadError{written, tracker.err}
+	}
+
+	return written, err
+}
+
+// writes ZIP archives
+type zipArchiveWriter struct {
+	z *zip.Writer
+}
+
+func newZipArchiveWriter(w io.Writer) (archiveWriter, error) {
+	return &zipArchiveWriter{zip.NewWriter(w)}, nil
+}
+
+func (a *zipArchiveWriter) WriteEntry(name string, file os.FileInfo, linkDest string, contents io.Reader) error {
+	// build a header we can use to generate a ZIP archive entry
+	header, err := zip.FileInfoHeader(file)
+	if err != nil {
+		return err
+	}
+
+	// ensure the name is set to relative path within the archive so we'll
+	// preserve the directory's structure.
+	header.Name = name
+
+	// NOTE: we don't need to do anything special for ZIP64. since the header
+	// doesn't give a compressed size, the entry gets a data descriptor with the
+	// real sizes after its contents, and Go switches that (and the central
+	// directory) to ZIP64 on its own once they exceed 4GB.
+
+	// add a directory entry for true directories so they'll show up even if
+	// they have no children. adding a trailing `/` does this for us,
+	// apparently.
+	fileIsSymlink := file.Mode()&os.ModeSymlink == os.ModeSymlink
+	if file.IsDir() && !fileIsSymlink {
+		header.Name += "/"
+	}
+
+	// generate an archive entry for this file/directory/symlink
+	zf, err := a.z.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if fileIsSymlink {
+		// according to the ZIP format, symlinks must have the namesake file mode
+		// with sole body content of the string path of the link's destination.
+		_, err = zf.Write([]byte(linkDest))
+	} else if contents != nil {
+		// the entry's size and checksum are computed from whatever we actually
+		// write, so a short read still leaves a valid (if truncated) entry.
+		_, err = copyEntryContents(zf, contents)
+	}
+
+	return err
+}
+
+func (a *zipArchiveWriter) Flush() error { return a.z.Flush() }
+func (a *zipArchiveWriter) Close() error { return a.z.Close() }
+
+// writes tar archives, optionally compressing them as they're written
+type tarArchiveWriter struct {
+	t          *tar.Writer
+	compressor io.WriteCloser // nil if the archive isn't compressed
+	flush      func() error   // flushes the compressor, if there is one
+}
+
+func newTarArchiveWriter(w io.Writer) (archiveWriter, error) {
+	return &tarArchiveWriter{t: tar.NewWriter(w)}, nil
+}
+
+func newTarGzipArchiveWriter(w io.Writer) (archiveWriter, error) {
+	gz := gzip.NewWriter(w)
+	return &tarArchiveWriter{tar.NewWriter(gz), gz, gz.Flush}, nil
+}
+
+func newTarZstdArchiveWriter(w io.Writer) (archiveWriter, error) {
+	zst, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tarArchiveWriter{tar.NewWriter(zst), zst, zst.Flush}, nil
+}
+
+func (a *tarArchiveWriter) WriteEntry(name string, file os.FileInfo, linkDest string, contents io.Reader) error {
+	// this fills in permissions and ownership (including user and group names)
+	// for us, and marks symlinks as such.
+	header, err := tar.FileInfoHeader(file, linkDest)
+	if err != nil {
+		return err
+	}
+
+	// directories are conventionally given a trailing `/` in tar archives too
+	header.Name = name
+	if header.Typeflag == tar.TypeDir {
+		header.Name += "/"
+	}
+
+	if err := a.t.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if header.Typeflag != tar.TypeReg || contents == nil {
+		return nil
+	}
+
+	// the header promised an exact number of bytes, so never write more than
+	// that even if the file has grown since we looked at it.
+	written, err := copyEntryContents(a.t, io.LimitReader(contents, header.Size))
+	if err == nil && written < header.Size {
+		// the file shrank out from under us
+		err = &archiveReadError{written, io.ErrUnexpectedEOF}
+	}
+
+	// if the contents came up short, pad the entry out to the size we promised
+	// so the rest of the archive stays intact.
+	if readErr, ok := err.(*archiveReadError); ok {
+		padding := bytes.NewReader(make([]byte, header.Size-written))
+		if _, err := io.Copy(a.t, padding); err != nil {
+			return err
+		}
+		return readErr
+	}
+
+	return err
+}
+
+func (a *tarArchiveWriter) Flush() error {
+	if err := a.t.Flush(); err != nil {
+		return err
+	}
+
+	if a.flush != nil {
+		return a.flush()
+	}
+
+	return nil
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.t.Close(); err != nil {
+		return err
+	}
+
+	if a.compressor != nil {
+		return a.compressor.Close()
+	}
+
+	return nil
+}
+
+// given a name and the set of names already used at the top level of an
+// archive, returns a unique version of the name, adding a number to it
+// (before the extension, if it has one) if it's already taken.
+func uniqueArchiveName(name string, isDir bool, used map[string]bool) string {
+	unique := name
+	ext := ""
+	if !isDir {
+		ext = path.Ext(name)
+	}
+
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+
+	used[unique] = true
+	return unique
+}
+
+// streams a single archive containing every file and directory given in the
+// `path` parameters, which may come from anywhere under the root. each one is
+// added to the top level of the archive under its own name.
+func downloadArchive(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	rawPaths := r.Form["path"]
+	if len(rawPaths) == 0 {
+		http.Error(w, "At least one path is required", 400)
+		return
+	}
+
+	format, ok := getArchiveFormat(r)
+	if !ok {
+		http.Error(w, "Unsupported archive format: "+r.Form.Get("format"), 400)
+		return
+	}
+
+	// make sure every path is valid before we start writing anything, since we
+	// can't report errors once the archive has started streaming.
+	normalizedPaths := make([]string, len(rawPaths))
+	names := make([]string, len(rawPaths))
+	used := map[string]bool{}
+	for i, rawPath := range rawPaths {
+		normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		file, err := STORAGE.Lstat(normalizedPath)
+		if err != nil {
+			// don't report the raw error in case we leak server directory information
+			http.Error(w, "Could not find "+rawPath, 404)
+			return
+		}
+
+		// give the root directory a generic name rather than its real one
+		name := file.Name()
+		if normalizedPath == ROOT {
+			name = "files"
+		}
+
+		normalizedPaths[i] = normalizedPath
+		names[i] = uniqueArchiveName(name, file.IsDir(), used)
+	}
+
+	if !setContentDisposition(w, r, "files"+format.Extension, dispositionAttachment) {
+		return
+	}
+
+	w.Header().Add("Content-Type", format.MIMEType)
+	w.Header().Add("Cache-Control", "no-cache")
+
+	archive, err := format.NewWriter(w)
+	if err != nil {
+		http.Error(w, "Failed to generate archive", 500)
+		return
+	}
+
+	// once the archive has started streaming there's no way to report errors to
+	// the client, so all we can do is stop.
+	streamer := newArchiveStreamer(r.Context(), archive)
+	for i, normalizedPath := range normalizedPaths {
+		if err := streamer.AddTree(normalizedPath, names[i]); err != nil {
+			if r.Context().Err() == nil {
+				log.Printf("Failed to archive %s: %s", normalizedPath, err)
+			}
+			return
+		}
+	}
+
+	if err := streamer.Close(); err != nil && r.Context().Err() == nil {
+		log.Printf("Failed to finish archive: %s", err)
+	}
+}
+
+// the name of the entry listing everything we couldn't add to an archive
+const archiveErrorsName = "ARCHIVE_ERRORS.txt"
+
+// describes a file that only exists inside an archive
+type archiveFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (f archiveFileInfo) Name() string       { return f.name }
+func (f archiveFileInfo) Size() int64        { return f.size }
+func (f archiveFileInfo) Mode() os.FileMode  { return 0644 }
+func (f archiveFileInfo) ModTime() time.Time { return f.modTime }
+func (f archiveFileInfo) IsDir() bool        { return false }
+func (f archiveFileInfo) Sys() interface{}   { return nil }
+
+// streams trees of files into an archive. files that can't be read are
+// skipped and listed in an extra entry at the end of the archive rather than
+// aborting the whole thing, since the client has no other way to find out.
+type archiveStreamer struct {
+	ctx     context.Context
+	archive archiveWriter
+	skipped []string // a line describing each file we couldn't add
+}
+
+// returns a streamer that writes to the given archive, stopping once the
+// context is cancelled (i.e. when the client goes away).
+func newArchiveStreamer(ctx context.Context, archive archiveWriter) *archiveStreamer {
+	return &archiveStreamer{ctx: ctx, archive: archive}
+}
+
+// remembers that a file couldn't be added to the archive, and why
+func (s *archiveStreamer) skip(filePath string, reason string) {
+	s.skipped = append(s.skipped, fmt.Sprintf("%s: %s", filePath, reason))
+}
+
+// walks the tree rooted at the given path and adds everything in it to the
+// archive, naming each entry by its path relative to that root, under the
+// given prefix. only returns an error if the archive itself can't be written
+// to or the context was cancelled, in which case the archive is unusable.
+func (s *archiveStreamer) AddTree(rootPath string, prefix string) error {
+	return walkStorage(STORAGE, rootPath, func(fullFilePath string, file os.FileInfo, err error) error {
+		// stop as soon as the client goes away, there's nobody to send to
+		if ctxErr := s.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		// use the relative file path so we don't accidentally leak the full path
+		// anywhere. we only use the full path to read the file from disk. we know
+		// it's relative so we can ignore the error.
+		filePath, _ := filepath.Rel(rootPath, fullFilePath)
+		if prefix != "" {
+			filePath = filepath.Join(prefix, filePath)
+		}
+		filePath = filepath.ToSlash(filePath)
+
+		if err != nil {
+			// don't say exactly what failed since doing so might leak the full path
+			s.skip(filePath, "could not be read")
+
+			// if we couldn't list a directory's contents, move on past it
+			if file != nil && file.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// neither the trash nor half-written temporary files are part of the tree
+		// as far as anyone can see
+		if isReservedName(file.Name()) {
+			if file.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if err := s.addFile(fullFilePath, filePath, file); err != nil {
+			return err
+		}
+
+		// flush what we've written so far to the client so the download will be
+		// as incremental as possible. doing flushes after every file also ensures
+		// that our memory usage doesn't balloon to the entire size of the
+		// archived directory, just the size of one file (which is better than
+		// nothing...).
+		return s.archive.Flush()
+	})
+}
+
+// adds a single file, directory or symlink to the archive
+func (s *archiveStreamer) addFile(fullFilePath string, filePath string, file os.FileInfo) error {
+	// if the file is a symlink, preserve it as such
+	if file.Mode()&os.ModeSymlink == os.ModeSymlink {
+		dest, err := STORAGE.Readlink(fullFilePath)
+		if err != nil {
+			s.skip(filePath, "could not resolve link")
+			return nil
+		}
+
+		return s.archive.WriteEntry(filePath, file, dest, nil)
+	}
+
+	// all we have to do for directories is create their entry
+	if file.IsDir() {
+		return s.archive.WriteEntry(filePath, file, "", nil)
+	}
+
+	// sockets, devices and the like have no contents worth archiving, and
+	// opening a named pipe would block forever.
+	if !file.Mode().IsRegular() {
+		s.skip(filePath, "not a regular file")
+		return nil
+	}
+
+	// open the file before writing anything so we can skip it cleanly if it
+	// can't be read. close it as soon as we're done so we're never holding more
+	// than one file open at a time.
+	f, err := STORAGE.Open(fullFilePath)
+	if err != nil {
+		s.skip(filePath, "could not be opened")
+		return nil
+	}
+	err = s.archive.WriteEntry(filePath, file, "", &contextReader{s.ctx, f})
+	f.Close()
+
+	// a file that fails part way through is left truncated in the archive. if
+	// the client went away, though, there's no point in carrying on.
+	if readErr, ok := err.(*archiveReadError); ok {
+		if ctxErr := s.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		s.skip(filePath, fmt.Sprintf("truncated after %d bytes", readErr.Written))
+		return nil
+	}
+
+	return err
+}
+
+// adds an entry listing any skipped files to the archive, then finishes it
+func (s *archiveStreamer) Close() error {
+	if len(s.skipped) > 0 {
+		manifest := "The following could not be added to this archive:\n\n" +
+			strings.Join(s.skipped, "\n") + "\n"
+		info := archiveFileInfo{archiveErrorsName, int64(len(manifest)), time.Now()}
+
+		err := s.archive.WriteEntry(archiveErrorsName, info, "", strings.NewReader(manifest))
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.archive.Close()
+}
+
+// a reader that fails once its context is cancelled, so we stop reading large
+// files as soon as the client goes away rather than after they're done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// a single file, directory or symlink inside an archive
+type archiveIndexEntry struct {
+	Path       string      `json:"path"` // cleaned, relative to the archive's root
+	Size       int64       `json:"size"`
+	ModTime    time.Time   `json:"mod_time"`
+	Mode       os.FileMode `json:"mode"`
+	LinkTarget string      `json:"link_target,omitempty"`
+
+	// where the entry's contents start within an uncompressed tar archive, so
+	// we can read them directly. -1 if the contents can't be read that way.
+	Offset int64 `json:"offset"`
+}
+
+// every entry in an archive, keyed by path
+type archiveIndex struct {
+	Entries map[string]*archiveIndexEntry `json:"entries"`
+}
+
+// returns the name of an entry
+func (e *archiveIndexEntry) Name() string { return path.Base(e.Path) }
+
+// returns whether an entry is a directory
+func (e *archiveIndexEntry) IsDir() bool { return e.Mode.IsDir() }
+
+// returns whether an entry is a symlink
+func (e *archiveIndexEntry) IsLink() bool { return e.Mode&os.ModeSymlink == os.ModeSymlink }
+
+// returns the JSON description of an entry, in the same form we describe
+// regular files in.
+func (e *archiveIndexEntry) InfoJSON() FileInfoJSON {
+	name := e.Name()
+	return FileInfoJSON{
+		name,
+		e.Size,
+		e.ModTime.UTC().Format("2006-01-02T15:04:05Z"), // ISO 8601
+		getMIMEType(name),
+		!e.IsDir() && isSourceCode(name),
+		e.IsDir(),
+		strings.HasPrefix(name, "."), // hidden?
+		e.IsLink(),
+
+		// links inside archives are never followed, so there's nothing to add
+		"",
+		false,
+
+		// entries can't be changed on their own, so they have no version
+		"",
+	}
+}
+
+// the kinds of archive we can look inside of
+const (
+	archiveKindNone = iota
+	archiveKindZip
+	archiveKindTar
+	archiveKindTarGzip
+	archiveKindTarZstd
+)
+
+// returns the kind of archive a file is based on its name
+func getArchiveKind(name string) int {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return archiveKindZip
+	case strings.HasSuffix(name, ".tar"):
+		return archiveKindTar
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return archiveKindTarGzip
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return archiveKindTarZstd
+	}
+
+	return archiveKindNone
+}
+
+// if the given path points at or inside an archive, returns the path of the
+// archive itself and the path of the entry within it. the entry path is empty
+// if the path points at the archive itself.
+func splitArchivePath(fullPath string) (string, string, bool) {
+	relPath, err := filepath.Rel(ROOT, fullPath)
+	if err != nil || relPath == "." {
+		return "", "", false
+	}
+
+	// find the first component that's actually an archive file
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	current := ROOT
+	for i, part := range parts {
+		current = filepath.Join(current, part)
+		if getArchiveKind(part) == archiveKindNone {
+			continue
+		}
+
+		file, err := STORAGE.Stat(current)
+		if err != nil {
+			return "", "", false
+		}
+		if file.Mode().IsRegular() {
+			return current, strings.Join(parts[i+1:], "/"), true
+		}
+	}
+
+	return "", "", false
+}
+
+// cleans an entry's name, returning false if it isn't safe to use (i.e. it
+// tries to escape the archive).
+func cleanArchiveEntryPath(name string) (string, bool) {
+	// some Windows tools use backslashes as separators, despite the specs
+	name = strings.Replace(name, "\\", "/", -1)
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	return cleaned, cleaned != ""
+}
+
+// adds an entry to the index, creating entries for any of its parent
+// directories that the archive didn't bother to include.
+func (index *archiveIndex) add(entry *archiveIndexEntry) {
+	if existing, ok := index.Entries[entry.Path]; !ok || !existing.IsDir() || entry.IsDir() {
+		index.Entries[entry.Path] = entry
+	}
+
+	for dir := path.Dir(entry.Path); dir != "."; dir = path.Dir(dir) {
+		if _, ok := index.Entries[dir]; ok {
+			break
+		}
+
+		index.Entries[dir] = &archiveIndexEntry{
+			Path:    dir,
+			ModTime: entry.ModTime,
+			Mode:    os.ModeDir | 0755,
+			Offset:  -1,
+		}
+	}
+}
+
+// returns the entries directly inside the given directory of the archive
+func (index *archiveIndex) children(dir string) []*archiveIndexEntry {
+	if dir == "" {
+		dir = "."
+	}
+
+	children := []*archiveIndexEntry{}
+	for _, entry := range index.Entries {
+		if path.Dir(entry.Path) == dir {
+			children = append(children, entry)
+		}
+	}
+
+	return children
+}
+
+// opens a ZIP archive. the returned function must be called once the archive
+// is no longer needed.
+func openZipArchive(archivePath string) (*zip.Reader, func(), error) {
+	f, err := STORAGE.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	z, err := zip.NewReader(f, size)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return z, func() { f.Close() }, nil
+}
+
+// builds an index of a ZIP archive from its central directory
+func buildZipIndex(archivePath string) (*archiveIndex, error) {
+	z, closeZip, err := openZipArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer closeZip()
+
+	index := &archiveIndex{map[string]*archiveIndexEntry{}}
+	for _, f := range z.File {
+		entryPath, ok := cleanArchiveEntryPath(f.Name)
+		if !ok {
+			continue
+		}
+
+		mode := f.Mode()
+		if strings.HasSuffix(f.Name, "/") {
+			mode |= os.ModeDir
+		}
+
+		index.add(&archiveIndexEntry{
+			Path:    entryPath,
+			Size:    int64(f.UncompressedSize64),
+			ModTime: f.Modified,
+			Mode:    mode,
+			Offset:  -1,
+		})
+	}
+
+	return index, nil
+}
+
+// counts the bytes read through it, so we can tell where tar entries start
+type countingReader struct {
+	r     io.Reader
+	count int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// opens a tar archive, decompressing it if necessary. the returned function
+// must be called once the stream is no longer needed.
+func openTarStream(archivePath string, kind int) (io.Reader, func(), error) {
+	f, err := STORAGE.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch kind {
+	case archiveKindTarGzip:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return gz, func() { f.Close() }, nil
+	case archiveKindTarZstd:
+		zst, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return zst, func() { zst.Close(); f.Close() }, nil
+	}
+
+	return f, func() { f.Close() }, nil
+}
+
+// builds an index of a tar archive by reading through the whole thing, since
+// tar archives have no central directory.
+func buildTarIndex(archivePath string, kind int) (*archiveIndex, error) {
+	stream, closeStream, err := openTarStream(archivePath, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer closeStream()
+
+	// we can only record where entries start if the archive isn't compressed
+	counter := &countingReader{r: stream}
+	tr := tar.NewReader(counter)
+
+	index := &archiveIndex{map[string]*archiveIndexEntry{}}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		entryPath, ok := cleanArchiveEntryPath(header.Name)
+		if !ok {
+			continue
+		}
+
+		offset := int64(-1)
+		if kind == archiveKindTar && header.Typeflag == tar.TypeReg {
+			offset = counter.count
+		}
+
+		index.add(&archiveIndexEntry{
+			Path:       entryPath,
+			Size:       header.Size,
+			ModTime:    header.ModTime,
+			Mode:       header.FileInfo().Mode(),
+			LinkTarget: header.Linkname,
+			Offset:     offset,
+		})
+	}
+
+	return index, nil
+}
+
+// returns the index for an archive. since building one can mean reading the
+// entire archive, indexes are cached for each version of the file.
+func loadArchiveIndex(archivePath string) (*archiveIndex, error) {
+	file, err := STORAGE.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	key := cacheKey(archivePath, file, "archive-index")
+	if cached, ok := readCache(key); ok {
+		index := &archiveIndex{}
+		if err := json.Unmarshal(cached, index); err == nil {
+			return index, nil
+		}
+	}
+
+	var index *archiveIndex
+	kind := getArchiveKind(archivePath)
+	if kind == archiveKindZip {
+		index, err = buildZipIndex(archivePath)
+	} else {
+		index, err = buildTarIndex(archivePath, kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// failing to cache isn't fatal, we'll just have to build it again later
+	if data, err := json.Marshal(index); err == nil {
+		if err := writeCache(key, data); err != nil {
+			log.Printf("Failed to cache archive index: %s", err)
+		}
+	}
+
+	return index, nil
+}
+
+// returns when an archive last changed, which is when anything inside it
+// last did too.
+func archiveModTime(archivePath string) time.Time {
+	file, err := STORAGE.Stat(archivePath)
+	if err != nil {
+		return time.Time{}
+	}
+	return file.ModTime()
+}
+
+// returns the info for an entry inside an archive
+func getArchiveEntryInfo(w http.ResponseWriter, r *http.Request, archivePath string, entryPath string, rawPath string) {
+	index, err := loadArchiveIndex(archivePath)
+	if err != nil {
+		http.Error(w, "Could not read archive", 500)
+		return
+	}
+
+	entry, ok := index.Entries[entryPath]
+	if !ok {
+		http.Error(w, "Could not find "+rawPath, 404)
+		return
+	}
+
+	writeCacheableJSONResponse(w, r, entry.InfoJSON(), archiveModTime(archivePath))
+}
+
+// lists a directory inside an archive, or the archive's root if the entry path
+// is empty.
+func getArchiveDirectory(w http.ResponseWriter, r *http.Request, archivePath string, entryPath string, rawPath string) {
+	index, err := loadArchiveIndex(archivePath)
+	if err != nil {
+		http.Error(w, "Could not read archive", 500)
+		return
+	}
+
+	if entryPath != "" {
+		if entry, ok := index.Entries[entryPath]; !ok || !entry.IsDir() {
+			http.Error(w, "Could not find "+rawPath, 404)
+			return
+		}
+	}
+
+	var files []FileInfoJSON
+	for _, entry := range index.children(entryPath) {
+		files = append(files, entry.InfoJSON())
+	}
+
+	// sort the files by our special sort order
+	sort.Sort(FileInfoJSONSorted(files))
+
+	writeCacheableJSONResponse(w, r, files, archiveModTime(archivePath))
+}
+
+// streams a single file out of an archive
+func downloadArchiveEntry(w http.ResponseWriter, r *http.Request, archivePath string, entryPath string, rawPath string) {
+	index, err := loadArchiveIndex(archivePath)
+	if err != nil {
+		http.Error(w, "Could not read archive", 500)
+		return
+	}
+
+	entry, ok := index.Entries[entryPath]
+	if !ok {
+		http.Error(w, "Could not find "+rawPath, 404)
+		return
+	}
+	if !entry.Mode.IsRegular() {
+		http.Error(w, "Only files can be downloaded from archives", 400)
+		return
+	}
+
+	if !setContentDisposition(w, r, entry.Name(), dispositionInline) {
+		return
+	}
+
+	w.Header().Add("Content-Type", getMIMEType(entry.Name()))
+
+	// uncompressed tar entries can be read directly, which means we can support
+	// range requests and the like just as we do for regular files.
+	if entry.Offset >= 0 {
+		f, err := STORAGE.Open(archivePath)
+		if err != nil {
+			http.Error(w, "Could not read archive", 500)
+			return
+		}
+		defer f.Close()
+
+		http.ServeContent(w, r, entry.Name(), entry.ModTime, io.NewSectionReader(f, entry.Offset, entry.Size))
+		return
+	}
+
+	// compressed tar archives have to be decompressed from the start to get to
+	// an entry, so keep every entry we extract from them for next time.
+	// otherwise fetching each file in turn would decompress the archive over
+	// and over again.
+	kind := getArchiveKind(archivePath)
+	cachedKey := ""
+	if kind != archiveKindZip {
+		archive, err := STORAGE.Stat(archivePath)
+		if err != nil {
+			http.Error(w, "Could not read archive", 500)
+			return
+		}
+
+		cachedKey = cacheKey(archivePath, archive, "archive-entry", entryPath)
+		if f, err := os.Open(cachePath(cachedKey)); err == nil {
+			defer f.Close()
+
+			http.ServeContent(w, r, entry.Name(), entry.ModTime, f)
+			return
+		}
+	}
+
+	var contents io.Reader
+	if kind == archiveKindZip {
+		// ZIP archives let us jump straight to the entry
+		z, closeZip, err := openZipArchive(archivePath)
+		if err != nil {
+			http.Error(w, "Could not read archive", 500)
+			return
+		}
+		defer closeZip()
+
+		for _, f := range z.File {
+			if name, ok := cleanArchiveEntryPath(f.Name); ok && name == entryPath {
+				rc, err := f.Open()
+				if err != nil {
+					http.Error(w, "Could not read archive", 500)
+					return
+				}
+				defer rc.Close()
+
+				contents = rc
+				break
+			}
+		}
+	} else {
+		// compressed tar archives have to be read from the start until we find it
+		stream, closeStream, err := openTarStream(archivePath, kind)
+		if err != nil {
+			http.Error(w, "Could not read archive", 500)
+			return
+		}
+		defer closeStream()
+
+		tr := tar.NewReader(stream)
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+
+			if name, ok := cleanArchiveEntryPath(header.Name); ok && name == entryPath && header.Typeflag == tar.TypeReg {
+				contents = tr
+				break
+			}
+		}
+	}
+
+	if contents == nil {
+		http.Error(w, "Could not find "+rawPath, 404)
+		return
+	}
+
+	// write the entry to the cache as we send it, keeping it only if all of it
+	// made it through
+	var out io.Writer = w
+	var cached *os.File
+	if cachedKey != "" {
+		if cached, err = createCacheEntry(cachedKey); err == nil {
+			out = io.MultiWriter(w, cached)
+		} else {
+			log.Printf("Failed to cache %s from %s: %s", entryPath, archivePath, err)
+		}
+	}
+
+	w.Header().Add("Content-Length", fmt.Sprint(entry.Size))
+	_, err = io.Copy(out, contents)
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Failed to extract %s from %s: %s", entryPath, archivePath, err)
+	}
+
+	if cached != nil {
+		commitCacheEntry(cachedKey, cached, err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+// reads every file in a ZIP archive, keyed by name
+func readTestZip(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{}
+	for _, entry := range z.File {
+		f, err := entry.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name] = string(contents)
+	}
+
+	return files
+}
+
+func TestDownloadArchive(t *testing.T) {
+	storage := useMemoryStorage(t)
+	writeTestFile(t, storage, "/bucket/docs/a.txt", []byte("a"))
+	writeTestFile(t, storage, "/bucket/docs/sub/b.txt", []byte("b"))
+	writeTestFile(t, storage, "/bucket/other/a.txt", []byte("other a"))
+
+	w := serveTestRequest(httptest.NewRequest("GET", "/archive?path=docs&path=other/a.txt", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	files := readTestZip(t, w.Body.Bytes())
+	if files["docs/a.txt"] != "a" || files["docs/sub/b.txt"] != "b" || files["a.txt"] != "other a" {
+		t.Errorf("unexpected archive contents: %v", files)
+	}
+
+	w = serveTestRequest(httptest.NewRequest("GET", "/archive?path=missing", nil))
+	if w.Code != 404 {
+		t.Errorf("expected 404 for a missing path, got %d", w.Code)
+	}
+}
+
+func TestBrowseArchive(t *testing.T) {
+	storage := useMemoryStorage(t)
+
+	var zipData bytes.Buffer
+	z := zip.NewWriter(&zipData)
+	for _, name := range []string{"inner/a.txt", "b.txt"} {
+		f, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("zip " + name))
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, storage, "/bucket/files.zip", zipData.Bytes())
+
+	var tarData bytes.Buffer
+	tw := tar.NewWriter(&tarData)
+	contents := []byte("tar c.txt")
+	tw.WriteHeader(&tar.Header{Name: "c.txt", Mode: 0644, Size: int64(len(contents))})
+	tw.Write(contents)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, storage, "/bucket/files.tar", tarData.Bytes())
+
+	var entries []FileInfoJSON
+	if code := getTestJSON(t, "/files/files.zip/", &entries); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "b.txt" || names[1] != "inner" {
+		t.Errorf("unexpected archive listing: %v", names)
+	}
+
+	var info FileInfoJSON
+	if code := getTestJSON(t, "/files/files.zip/inner/a.txt", &info); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if info.Name != "a.txt" || info.Size != int64(len("zip inner/a.txt")) {
+		t.Errorf("unexpected entry info: %+v", info)
+	}
+
+	tests := []struct {
+		url  string
+		body string
+	}{
+		{"/files/files.zip/inner/a.txt", "zip inner/a.txt"},
+		{"/files/files.tar/c.txt", "tar c.txt"},
+
+		// the second request for a tar member comes from the cache
+		{"/files/files.tar/c.txt", "tar c.txt"},
+	}
+	for _, test := range tests {
+		w := serveTestRequest(httptest.NewRequest("GET", test.url, nil))
+		if w.Code != 200 || w.Body.String() != test.body {
+			t.Errorf("%s: unexpected response: %d %q", test.url, w.Code, w.Body.String())
+		}
+	}
+
+	w := serveTestRequest(httptest.NewRequest("GET", "/files/files.zip/missing.txt", nil))
+	if w.Code != 404 {
+		t.Errorf("expected 404 for a missing entry, got %d", w.Code)
+	}
+
+	// listings can be revalidated like those of real directories
+	for _, url := range []string{"/files/files.zip/", "/files/files.zip/inner/a.txt"} {
+		r := httptest.NewRequest("GET", url, nil)
+		r.Header.Set("Content-Type", "application/json")
+		w := serveTestRequest(r)
+		etag := w.Header().Get("ETag")
+		if w.Code != 200 || etag == "" || w.Header().Get("Last-Modified") == "" {
+			t.Fatalf("%s: expected a cacheable response, got %d %v", url, w.Code, w.Header())
+		}
+
+		r.Header.Set("If-None-Match", etag)
+		if w := serveTestRequest(r); w.Code != 304 {
+			t.Errorf("%s: expected 304 when revalidating, got %d", url, w.Code)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// a format we can transcode audio to
+type audioFormat struct {
+	MIMEType string
+	Codec    string // the ffmpeg encoder to use
+	Muxer    string // the ffmpeg container format to use
+}
+
+// every format we can transcode audio to, keyed by the name clients ask for
+var audioFormats = map[string]audioFormat{
+	"opus": {"audio/ogg", "libopus", "ogg"},
+	"mp3":  {"audio/mpeg", "libmp3lame", "mp3"},
+	"aac":  {"audio/aac", "aac", "adts"},
+}
+
+const (
+	audioDefaultFormat  = "opus"
+	audioDefaultBitrate = 128 // in kilobits per second
+	audioMinBitrate     = 32  // in kilobits per second
+	audioMaxBitrate     = 320 // in kilobits per second
+)
+
+// streams an audio file transcoded on the fly to a format browsers can play.
+// the `format` query parameter selects the output format (`opus`, `mp3` or
+// `aac`), `bitrate` its bitrate in kilobits per second, and `start` the offset
+// in seconds to begin playing from.
+func getAudio(w http.ResponseWriter, r *http.Request) {
+	rawPath := mux.Vars(r)["path"]
+	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// ensure the file exists
+	file, err := STORAGE.Stat(normalizedPath)
+	if err != nil || file.IsDir() {
+		// don't report the raw error in case we leak server directory information
+		http.Error(w, "Could not find "+rawPath, 404)
+		return
+	}
+
+	mimeType := getMIMEType(normalizedPath)
+	if strings.Index(mimeType, "audio") != 0 {
+		// HTTP 415 - Unsupported Media Type
+		http.Error(w, "Unsupported file type: "+mimeType, 415)
+		return
+	}
+
+	// the file has to be on the local disk for ffmpeg to read it
+	filePath, err := localPath(normalizedPath)
+	if err != nil {
+		// HTTP 501 - Not Implemented
+		http.Error(w, err.Error(), 501)
+		return
+	}
+
+	query := r.URL.Query()
+
+	formatName := query.Get("format")
+	if formatName == "" {
+		formatName = audioDefaultFormat
+	}
+	format, ok := audioFormats[formatName]
+	if !ok {
+		http.Error(w, "Unsupported format: "+formatName, 400)
+		return
+	}
+
+	bitrate := audioDefaultBitrate
+	if rawBitrate := query.Get("bitrate"); rawBitrate != "" {
+		bitrate, err = strconv.Atoi(rawBitrate)
+		if err != nil || bitrate < audioMinBitrate || bitrate > audioMaxBitrate {
+			http.Error(w, fmt.Sprintf("Bitrate must be between %d and %d", audioMinBitrate, audioMaxBitrate), 400)
+			return
+		}
+	}
+
+	start := 0.0
+	if rawStart := query.Get("start"); rawStart != "" {
+		start, err = strconv.ParseFloat(rawStart, 64)
+		if err != nil || start < 0 {
+			http.Error(w, "Invalid start: "+rawStart, 400)
+			return
+		}
+	}
+
+	cmd := exec.Command(
+		"ffmpeg",
+
+		// only complain if something actually goes wrong
+		"-v", "error",
+
+		// jump to where the client wants to start. doing this before the input
+		// makes ffmpeg seek using the container's index, which is much faster.
+		"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+
+		// the file we're processing
+		"-i", filePath,
+
+		// drop any cover art, we only want the audio
+		"-vn",
+
+		// transcode to the requested format
+		"-c:a", format.Codec,
+		"-b:a", fmt.Sprintf("%dk", bitrate),
+		"-f", format.Muxer,
+
+		// output to stdout
+		"-",
+	)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		http.Error(w, "Error transcoding audio", 500)
+		return
+	}
+
+	// this holds its slot for as long as the client keeps listening, so slow
+	// listeners count against the same limit as thumbnail generation.
+	acquireProcessSlot()
+	defer releaseProcessSlot()
+
+	if err := cmd.Start(); err != nil {
+		http.Error(w, "Error transcoding audio", 500)
+		return
+	}
+
+	// the length of the output isn't known until it's done, so clients have to
+	// seek using the `start` parameter rather than byte ranges.
+	w.Header().Add("Content-Type", format.MIMEType)
+	w.Header().Add("Cache-Control", "no-cache")
+	w.Header().Add("Accept-Ranges", "none")
+
+	// stream the output as it's generated. if the client goes away the copy
+	// fails, at which point there's no sense in continuing to transcode.
+	if _, err := io.Copy(newFlushWriter(w), stdout); err != nil {
+		cmd.Process.Kill()
+	}
+
+	if err := cmd.Wait(); err != nil && r.Context().Err() == nil {
+		log.Printf("Transcode of %s failed: %s", normalizedPath, err)
+	}
+}
+
+// a writer that sends everything written to it on to the client right away,
+// rather than waiting for the response's buffer to fill.
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func newFlushWriter(w http.ResponseWriter) io.Writer {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return w
+	}
+	return &flushWriter{w, f}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.f.Flush()
+	return n, err
+}
@@ -1,23 +1,23 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"mime"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -37,6 +37,52 @@ type FileInfoJSON struct {
 	IsDirectory bool   `json:"is_directory"`
 	IsHidden    bool   `json:"is_hidden"`
 	IsLink      bool   `json:"is_link"`
+
+	// where a link leads, if it's somewhere we can say, and whether it can't
+	// be followed, either because nothing is there or the policy forbids it.
+	LinkTarget   string `json:"link_target,omitempty"`
+	IsBrokenLink bool   `json:"is_broken_link"`
+
+	// changes whenever the file does, unlike the modification time which is
+	// only given to the second. it's the version signatures give, too.
+	Version string `json:"version,omitempty"`
+}
+
+// returns the JSON description of a file given its info from Lstat. links are
+// described by what they point to, so a link to a directory is a directory.
+func newFileInfoJSON(fullPath string, file os.FileInfo) FileInfoJSON {
+	isLink := file.Mode()&os.ModeSymlink == os.ModeSymlink
+	linkTarget := ""
+	isBrokenLink := false
+	if isLink {
+		var followable bool
+		linkTarget, followable = describeLink(fullPath)
+		if target, err := STORAGE.Stat(fullPath); followable && err == nil {
+			file = target
+		} else {
+			isBrokenLink = true
+		}
+	}
+
+	version := ""
+	if !file.IsDir() {
+		version = deltaVersion(fullPath, file)
+	}
+
+	name := path.Base(fullPath)
+	return FileInfoJSON{
+		name,
+		file.Size(),
+		file.ModTime().UTC().Format("2006-01-02T15:04:05Z"), // ISO 8601
+		getMIMEType(name),
+		!file.IsDir() && isSourceCode(name),
+		file.IsDir(),
+		strings.HasPrefix(name, "."), // hidden?
+		isLink,
+		linkTarget,
+		isBrokenLink,
+		version,
+	}
 }
 
 type FileInfoJSONSorted []FileInfoJSON
@@ -143,6 +189,62 @@ func writeJSONResponse(w http.ResponseWriter, data interface{}) {
 	w.Write(json)
 }
 
+// writes a JSON response describing something last modified at the given
+// time, along with validators so clients can skip downloading it again if
+// nothing has changed. the ETag covers the response itself, so it changes
+// whenever anything in it does.
+func writeCacheableJSONResponse(w http.ResponseWriter, r *http.Request, data interface{}, modTime time.Time) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, "Failed to generate JSON response", 500)
+		return
+	}
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%d\x00", modTime.UnixNano())
+	h.Write(body)
+	etag := `W/"` + hex.EncodeToString(h.Sum(nil)) + `"`
+
+	// the same URLs serve files when JSON isn't asked for
+	w.Header().Add("Vary", "Content-Type")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+
+	if notModified(r, etag, modTime) {
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeJSONResponse(w, json.RawMessage(body))
+}
+
+// returns whether the client's copy of something with the given validators
+// is still current, according to its conditional request headers.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	// ETags take precedence, since they're more precise than timestamps
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+
+			// a weak comparison, since our JSON ETags are all weak
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+
+		// HTTP dates only go down to the second
+		return err == nil && !modTime.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
 // given a file name, returns a MIME type based on its extension
 func getMIMEType(filePath string) string {
 	dotIndex := strings.LastIndex(filePath, ".")
@@ -153,66 +255,177 @@ func getMIMEType(filePath string) string {
 	return mime.TypeByExtension(filePath[dotIndex:])
 }
 
+// whether a download should be shown by the browser or saved, per RFC 6266
+const (
+	dispositionInline     = "inline"
+	dispositionAttachment = "attachment"
+)
+
+// returns a Content-Disposition header value for the given file name. every
+// browser understands the plain `filename` parameter, so it gets a version of
+// the name with anything that isn't printable ASCII replaced. the real name
+// goes in `filename*` using RFC 5987 encoding, which modern browsers prefer.
+func formatContentDisposition(dispositionType string, name string) string {
+	fallback := []rune{}
+	encoded := ""
+	for _, c := range name {
+		switch {
+		case c < 0x20 || c > 0x7e:
+			fallback = append(fallback, '_')
+		case c == '"' || c == '\\':
+			fallback = append(fallback, '\\', c)
+		default:
+			fallback = append(fallback, c)
+		}
+	}
+
+	for _, b := range []byte(name) {
+		// the attr-char set from RFC 5987, everything else is percent-encoded
+		if b < 0x80 && (unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b)) || strings.IndexByte("!#$&+-.^_`|~", b) >= 0) {
+			encoded += string(b)
+		} else {
+			encoded += fmt.Sprintf("%%%02X", b)
+		}
+	}
+
+	value := fmt.Sprintf(`%s; filename="%s"`, dispositionType, string(fallback))
+	if encoded != name {
+		value += "; filename*=UTF-8''" + encoded
+	}
+	return value
+}
+
+// sets the Content-Disposition header for a download with the given name. the
+// `disposition` parameter picks `inline` or `attachment`, falling back to the
+// given default. returns false, having already responded, if it's invalid.
+func setContentDisposition(w http.ResponseWriter, r *http.Request, name string, defaultType string) bool {
+	dispositionType := r.FormValue("disposition")
+	switch dispositionType {
+	case "":
+		dispositionType = defaultType
+	case dispositionInline, dispositionAttachment:
+	default:
+		http.Error(w, "Unsupported disposition: "+dispositionType, 400)
+		return false
+	}
+
+	w.Header().Set("Content-Disposition", formatContentDisposition(dispositionType, name))
+	return true
+}
+
+// returns whether a path contains NUL or other control characters. no file
+// we'd want to serve has them in its name, and they tend to confuse anything
+// that logs or displays the path.
+func hasControlCharacters(p string) bool {
+	for _, c := range p {
+		if unicode.IsControl(c) {
+			return true
+		}
+	}
+	return false
+}
+
 // given a root and a relative child path, returns the normalized, absolute path
 // of the child. if the path is not a child of the root or is otherwise invalid,
 // returns an error.
+//
+// NOTE: the child must already be decoded. mux decodes the paths it matches,
+// so decoding them again would turn a file named `%2e%2e` into `..`.
 func normalizePathUnderRoot(root, child string) (string, error) {
-	// clean the path, resolving any ".."s in it
-	requestPath := path.Clean(path.Join(root, child))
+	// keep things vague since someone's probably trying to be sneaky anyway
+	if hasControlCharacters(child) {
+		return "", fmt.Errorf("Invalid path")
+	}
+
+	// clean the path on its own, resolving any ".."s in it. the only ones left
+	// after that are the ones that would climb out of the root. names that
+	// merely contain two dots, like `notes..txt`, are fine.
+	cleanPath := path.Clean(strings.TrimLeft(child, "/"))
+	for _, part := range strings.Split(cleanPath, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("Invalid path")
+		}
+	}
+	requestPath := filepath.Join(root, filepath.FromSlash(cleanPath))
 
-	// if the path exited the root directory, fail
+	// make certain the result didn't somehow exit the root directory
 	relPath, err := filepath.Rel(root, requestPath)
-	if err != nil || strings.Index(relPath, "..") >= 0 {
-		// keep things vague since someone's probably trying to be sneaky anyway
+	if err != nil || relPathEscapes(relPath) {
+		return "", fmt.Errorf("Invalid path")
+	}
+
+	// the trash is only reachable through its own endpoints, and temporary
+	// files aren't anyone's business
+	if containsReservedName(relPath) {
 		return "", fmt.Errorf("Invalid path")
 	}
 
+	// the path might still lead somewhere else through a symlink
+	if err := checkSymlinks(requestPath); err != nil {
+		return "", err
+	}
+
 	return requestPath, nil
 }
 
+// returns whether a path on the local disk, which may be relative to the
+// working directory, is the root or anywhere under it. the server's own files
+// must never be, or they'd be served along with everything else.
+func isUnderRoot(name string) bool {
+	absName, err := filepath.Abs(name)
+	if err != nil {
+		return true
+	}
+
+	roots := []string{ROOT}
+	if realRoot, err := filepath.EvalSymlinks(ROOT); err == nil {
+		roots = append(roots, realRoot)
+	}
+	for _, root := range roots {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return true
+		}
+		if relPath, err := filepath.Rel(absRoot, absName); err == nil && !relPathEscapes(relPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // this returns the info for the specified files _or_ directory, not just files
 func getInfo(w http.ResponseWriter, r *http.Request) {
 	// make sure our path is valid
-	rawPath, err := url.QueryUnescape(mux.Vars(r)["path"])
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
+	rawPath := mux.Vars(r)["path"]
 	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	// stat the file so we can return its info
-	fileInfo, err := os.Stat(normalizedPath)
+	// stat the file so we can return its info, without following it if it's a
+	// link so we can tell clients that it is one.
+	fileInfo, err := STORAGE.Lstat(normalizedPath)
 	if err != nil {
+		// the path might point inside an archive rather than at a real file
+		if archivePath, entryPath, ok := splitArchivePath(normalizedPath); ok {
+			getArchiveEntryInfo(w, r, archivePath, entryPath, rawPath)
+			return
+		}
+
 		// don't report the raw error in case we leak server directory information
 		http.Error(w, "Could not find "+rawPath, 404)
 		return
 	}
 
-	mimeType := getMIMEType(normalizedPath)
-
-	writeJSONResponse(w, FileInfoJSON{
-		fileInfo.Name(),
-		fileInfo.Size(),
-		fileInfo.ModTime().Format("2006-01-02T15:04:05Z"), // ISO 8601
-		mimeType,
-		!fileInfo.IsDir() && isSourceCode(fileInfo.Name()),
-		fileInfo.IsDir(),
-		strings.HasPrefix(fileInfo.Name(), "."),
-		fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink,
-	})
+	info := newFileInfoJSON(normalizedPath, fileInfo)
+	writeCacheableJSONResponse(w, r, info, fileInfo.ModTime())
 }
 
 func download(w http.ResponseWriter, r *http.Request) {
 	// make sure our path is valid
-	rawPath, err := url.QueryUnescape(mux.Vars(r)["path"])
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
+	rawPath := mux.Vars(r)["path"]
 	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
@@ -221,8 +434,14 @@ func download(w http.ResponseWriter, r *http.Request) {
 
 	// stat the file so we can set appropriate response headers, and so we can
 	// ensure it's a regular file and not a directory.
-	file, err := os.Stat(normalizedPath)
+	file, err := STORAGE.Stat(normalizedPath)
 	if err != nil {
+		// the path might point inside an archive rather than at a real file
+		if archivePath, entryPath, ok := splitArchivePath(normalizedPath); ok {
+			downloadArchiveEntry(w, r, archivePath, entryPath, rawPath)
+			return
+		}
+
 		// don't report the raw error in case we leak server directory information
 		http.Error(w, "Could not find "+rawPath, 404)
 		return
@@ -237,167 +456,127 @@ func download(w http.ResponseWriter, r *http.Request) {
 }
 
 func downloadFile(w http.ResponseWriter, r *http.Request, filePath string, file os.FileInfo) {
+	if !setContentDisposition(w, r, file.Name(), dispositionInline) {
+		return
+	}
+
 	mimeType := getMIMEType(filePath)
 	w.Header().Add("Content-Type", mimeType)
-	w.Header().Add("Content-Disposition", file.Name())
-	w.Header().Add("Cache-Control", "no-cache")
+	addDigestHeader(w, filePath, file)
 
-	http.ServeFile(w, r, filePath)
-}
+	// let clients revalidate (and resume) downloads without the date's
+	// one-second granularity getting in the way.
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, file.Size(), file.ModTime().UnixNano()))
 
-func getDirectory(w http.ResponseWriter, r *http.Request) {
-	// ensure the directory actually exists
-	rawPath, err := url.QueryUnescape(mux.Vars(r)["path"])
+	f, err := STORAGE.Open(filePath)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		http.Error(w, "Could not open "+file.Name(), 500)
 		return
 	}
+	defer f.Close()
+
+	http.ServeContent(w, r, file.Name(), file.ModTime(), f)
+}
+
+func getDirectory(w http.ResponseWriter, r *http.Request) {
+	// ensure the directory actually exists
+	rawPath := mux.Vars(r)["path"]
 	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	children, err := ioutil.ReadDir(normalizedPath)
+	children, err := STORAGE.ReadDir(normalizedPath)
 	if err != nil {
+		// archives can be browsed like directories
+		if archivePath, entryPath, ok := splitArchivePath(normalizedPath); ok {
+			getArchiveDirectory(w, r, archivePath, entryPath, rawPath)
+			return
+		}
+
 		// don't report the raw error in case we leak server directory information
 		http.Error(w, "Could not find "+rawPath, 404)
 		return
 	}
 
+	// the listing changes whenever the directory or anything in it does
+	modTime := time.Time{}
+	if dir, err := STORAGE.Stat(normalizedPath); err == nil {
+		modTime = dir.ModTime()
+	}
+
 	// list the directory to a JSON response
 	var files []FileInfoJSON
 	for _, file := range children {
 		fileName := file.Name()
-		files = append(files, FileInfoJSON{
-			fileName,
-			file.Size(),
-			file.ModTime().Format("2006-01-02T15:04:05Z"), // ISO 8601
-			getMIMEType(fileName),
-			!file.IsDir() && isSourceCode(fileName),
-			file.IsDir(),
-			strings.HasPrefix(fileName, "."), // hidden?
-			file.Mode()&os.ModeSymlink == os.ModeSymlink,
-		})
+		if isReservedName(fileName) {
+			continue
+		}
+
+		if file.ModTime().After(modTime) {
+			modTime = file.ModTime()
+		}
+
+		files = append(files, newFileInfoJSON(path.Join(normalizedPath, fileName), file))
 	}
 
 	// sort the files by our special sort order
 	sort.Sort(FileInfoJSONSorted(files))
 
-	writeJSONResponse(w, files)
+	writeCacheableJSONResponse(w, r, files, modTime)
 }
 
-// zip up a directory and write it to the response stream
+// archive a directory and write it to the response stream
 func downloadDirectory(w http.ResponseWriter, r *http.Request, dirPath string) {
+	format, ok := getArchiveFormat(r)
+	if !ok {
+		http.Error(w, "Unsupported archive format: "+r.URL.Query().Get("format"), 400)
+		return
+	}
+
 	// give the file a nice name, but replace the root directory name with
 	// something generic.
 	var downloadName string
 	if dirPath == ROOT {
-		downloadName = "files.zip"
+		downloadName = "files" + format.Extension
 	} else {
-		downloadName = path.Base(dirPath) + ".zip"
+		downloadName = path.Base(dirPath) + format.Extension
 	}
 
-	w.Header().Add("Content-Type", "application/zip")
-	w.Header().Add("Content-Disposition", downloadName)
-	w.Header().Add("Cache-Control", "no-cache")
-
-	z := zip.NewWriter(w)
-	defer z.Close()
-
-	// walk the directory and add each file to the zip file, giving up (returning
-	// an error) if we encounter an error anywhere along the line.
-	filepath.Walk(dirPath, func(fullFilePath string, file os.FileInfo, err error) error {
-		if err != nil {
-			// don't say what failed since doing so might leak the full path
-			http.Error(w, "Failed to generate archive", 500)
-			return err
-		}
-
-		// use the relative file path so we don't accidentally leak the full path
-		// anywhere. we only use the full path to read the file from disk. we know
-		// it's relative so we can ignore the error.
-		filePath, _ := filepath.Rel(dirPath, fullFilePath)
-
-		// build a header we can use to generate a ZIP archive entry
-		header, err := zip.FileInfoHeader(file)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to generate archive header for %s", filePath), 500)
-			return err
-		}
-
-		// ensure the name is set to relative path within this directory so we'll
-		// preserve the directory's structure within the archive.
-		header.Name = filePath
-
-		// add a directory entry for true directories so they'll show up even if
-		// they have no children. adding a trailing `/` does this for us,
-		// apparently.
-		fileIsSymlink := file.Mode()&os.ModeSymlink == os.ModeSymlink
-		if file.IsDir() && !fileIsSymlink {
-			header.Name += "/"
-		}
-
-		// generate an archive entry for this file/directory/symlink
-		zf, err := z.CreateHeader(header)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to add %s to archive", filePath), 500)
-			return err
-		}
-
-		// if the file is a symlink, preserve it as such
-		if fileIsSymlink {
-			// according to the ZIP format, symlinks must have the namesake file mode
-			// with sole body content of the string path of the link's destination.
-			dest, err := os.Readlink(fullFilePath)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Failed to resolve %s", filePath), 500)
-				return err
-			}
+	if !setContentDisposition(w, r, downloadName, dispositionAttachment) {
+		return
+	}
 
-			zf.Write([]byte(dest))
-		} else if file.IsDir() {
-			// NOTE: do nothing since all we have to do for directories is create
-			// their header entry, which has already been done.
-		} else {
-			// open the file for reading
-			f, err := os.Open(fullFilePath)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Failed to read %s", filePath), 500)
-				return err
-			}
-			defer f.Close()
+	w.Header().Add("Content-Type", format.MIMEType)
+	w.Header().Add("Cache-Control", "no-cache")
 
-			// write the file contents to the archive
-			written, err := io.Copy(zf, f)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Failed to write %s to archive after %d bytes", filePath, written), 500)
-				return err
-			}
-		}
+	archive, err := format.NewWriter(w)
+	if err != nil {
+		http.Error(w, "Failed to generate archive", 500)
+		return
+	}
 
-		// flush what we've written so far to the client so the download will be as
-		// incremental as possible. doing flushes after every file also ensures that
-		// our memory usage doesn't balloon to the entire size of the zipped
-		// directory, just the size of one file (which is better than nothing...).
-		err = z.Flush()
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to flush data for %s", filePath), 500)
-			return err
+	// if something goes wrong part way through there's nothing we can tell the
+	// client, since the archive has already started streaming. all we can do is
+	// stop and leave them with a truncated download.
+	streamer := newArchiveStreamer(r.Context(), archive)
+	if err := streamer.AddTree(dirPath, ""); err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("Failed to archive %s: %s", dirPath, err)
 		}
+		return
+	}
 
-		return nil
-	})
+	if err := streamer.Close(); err != nil && r.Context().Err() == nil {
+		log.Printf("Failed to finish archive of %s: %s", dirPath, err)
+	}
 }
 
 // generates a thumbnail file given a path, or returns an error if no thumbnail
 // could be generated.
 func getThumbnail(w http.ResponseWriter, r *http.Request) {
-	rawPath, err := url.QueryUnescape(mux.Vars(r)["path"])
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
+	rawPath := mux.Vars(r)["path"]
 	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
@@ -405,7 +584,7 @@ func getThumbnail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// ensure the file exists
-	_, err = os.Stat(normalizedPath)
+	file, err := STORAGE.Stat(normalizedPath)
 	if err != nil {
 		// don't report the raw error in case we leak server directory information
 		http.Error(w, "Could not find "+rawPath, 404)
@@ -423,11 +602,38 @@ func getThumbnail(w http.ResponseWriter, r *http.Request) {
 	size := "64"    // square size of the image in pixels
 	quality := 0.25 // quality of the image as fraction between 0 and 1
 
+	// serve a previously-generated thumbnail if we have one for this version of
+	// the file, since generating them is expensive.
+	key := cacheKey(normalizedPath, file, "thumbnail", size, fmt.Sprint(quality))
+	if thumbnail, ok := readCache(key); ok {
+		w.Header().Add("Content-Type", "image/jpeg")
+		w.Write(thumbnail)
+		return
+	}
+
 	if mimeType == "image/svg+xml" {
 		// simply return the image as-is if it's an SVG image
-		http.ServeFile(w, r, normalizedPath)
+		f, err := STORAGE.Open(normalizedPath)
+		if err != nil {
+			http.Error(w, "Could not read "+rawPath, 500)
+			return
+		}
+		defer f.Close()
+
+		http.ServeContent(w, r, file.Name(), file.ModTime(), f)
+		return
+	}
+
+	// the file has to be on the local disk for GraphicsMagick and ffmpeg to
+	// read it
+	filePath, err := localPath(normalizedPath)
+	if err != nil {
+		// HTTP 501 - Not Implemented
+		http.Error(w, err.Error(), 501)
 		return
-	} else if strings.Index(mimeType, "image") == 0 {
+	}
+
+	if strings.Index(mimeType, "image") == 0 {
 		// hint to the encoder that we're not making a very large image, which
 		// apparently saves memory and cycles. the ^ tells it to treat these as
 		// minimum dimensions, but to preserve the aspect ratio.
@@ -443,7 +649,7 @@ func getThumbnail(w http.ResponseWriter, r *http.Request) {
 			"-size", gmSize,
 
 			// the file we're processing
-			normalizedPath,
+			filePath,
 
 			// this tells it we really want this as the true output size of our image
 			"-geometry", gmSize,
@@ -463,7 +669,7 @@ func getThumbnail(w http.ResponseWriter, r *http.Request) {
 			"ffmpeg",
 
 			// the file we're processing
-			"-i", normalizedPath,
+			"-i", filePath,
 
 			// generate an image with a minimum dimension of our size, preserving the
 			// original aspect ratio.
@@ -488,21 +694,19 @@ func getThumbnail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// run the command we created above and get its JPEG output
-	var out bytes.Buffer
-	var eOut bytes.Buffer
-
-	cmd.Stdout = &out
-	cmd.Stderr = &eOut
-
-	err = cmd.Run()
+	thumbnail, err := runProcess(cmd)
 	if err != nil {
 		http.Error(w, "Error generating thumbnail", 500)
-		log.Printf("%s", eOut.String())
 		return
 	}
 
+	// failing to cache isn't fatal, we'll just have to generate it again later
+	if err := writeCache(key, thumbnail); err != nil {
+		log.Printf("Failed to cache thumbnail: %s", err)
+	}
+
 	w.Header().Add("Content-Type", "image/jpeg")
-	w.Write(out.Bytes())
+	w.Write(thumbnail)
 }
 
 // log requests to the console
@@ -510,27 +714,198 @@ func loggingHandler(h http.Handler) http.Handler {
 	return handlers.CombinedLoggingHandler(os.Stdout, h)
 }
 
+// compresses responses, except for audio streams. those are compressed already,
+// and compressing them again would only hold up each chunk of the stream.
+func compressHandler(h http.Handler) http.Handler {
+	compressed := handlers.CompressHandler(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/audio/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		compressed.ServeHTTP(w, r)
+	})
+}
+
 func main() {
+	// act as a client instead if we were given one of its commands
+	if runClient(os.Args[1:]) {
+		return
+	}
+
+	cacheRoot := flag.String("cache", filepath.Join(os.TempDir(), "bucket"),
+		"directory to cache generated thumbnails and previews in")
+	workers := flag.Int("workers", runtime.NumCPU(),
+		"maximum number of thumbnail/preview processes to run at once")
+	transcodes := flag.Int("transcodes", MAX_TRANSCODES,
+		"maximum number of videos to transcode for streaming at once")
+	extractMaxBytes := flag.Int64("extract-max-bytes", MAX_EXTRACT_BYTES,
+		"maximum number of bytes a single archive may extract to")
+	extractMaxEntries := flag.Int64("extract-max-entries", MAX_EXTRACT_ENTRIES,
+		"maximum number of entries a single archive may extract")
+	s3Addr := flag.String("s3-addr", "",
+		"address to serve the S3-compatible API on (disabled if empty)")
+	s3Keys := flag.String("s3-keys", "",
+		"file of `ACCESS_KEY SECRET_KEY` pairs allowed to use the S3 API")
+	sftpAddr := flag.String("sftp-addr", "",
+		"address to serve SFTP on (disabled if empty)")
+	sftpAuthorizedKeys := flag.String("sftp-authorized-keys", "",
+		"authorized_keys file listing the public keys allowed to use SFTP")
+	sftpHostKey := flag.String("sftp-host-key", "",
+		"file outside the root to keep the SFTP host key in, generated if it doesn't exist (defaults to one in the cache directory)")
+	versionsRoot := flag.String("versions", "",
+		"directory outside the root to keep previous versions of overwritten files in (defaults to one in the cache directory)")
+	maxVersions := flag.Int("versions-keep", MAX_VERSIONS,
+		"maximum number of previous versions to keep per file (0 for no limit)")
+	maxVersionAge := flag.Duration("versions-max-age", MAX_VERSION_AGE,
+		"how long to keep previous versions of files for (0 for no limit)")
+	trashEnabled := flag.Bool("trash", TRASH_ENABLED,
+		"move deleted files to the trash instead of deleting them outright")
+	trashMaxAge := flag.Duration("trash-max-age", TRASH_MAX_AGE,
+		"how long to keep deleted files in the trash for (0 for no limit)")
+	trashMaxSize := flag.Int64("trash-max-size", TRASH_MAX_SIZE,
+		"maximum number of bytes to keep in the trash (0 for no limit)")
+	symlinks := flag.String("symlinks", SYMLINK_POLICY,
+		"which symlinks to follow: `root` (only those leading inside the root), any or never")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: bucket [options] <root directory>\n\n")
+		flag.PrintDefaults()
+		printClientUsage()
+	}
+	flag.Parse()
+
 	// ensure we have all the binaries we need
-	requiredBinaries := []string{"gm", "ffmpeg"}
+	requiredBinaries := []string{"gm", "ffmpeg", "ffprobe"}
 	for _, binary := range requiredBinaries {
 		if _, err := exec.LookPath(binary); err != nil {
 			log.Panicf("'%s' must be installed and in the PATH\n", binary)
 		}
 	}
 
-	if len(os.Args) <= 1 {
+	if flag.NArg() < 1 {
 		panic("A root directory argument is required")
 	}
 
-	ROOT = path.Clean(os.Args[1])
+	if *workers < 1 {
+		panic("At least one worker is required")
+	}
+
+	if *transcodes < 1 {
+		panic("At least one transcode is required")
+	}
+
+	switch *symlinks {
+	case symlinksRoot, symlinksAny, symlinksNever:
+		SYMLINK_POLICY = *symlinks
+	default:
+		panic("-symlinks must be one of root, any or never")
+	}
+
+	ROOT = path.Clean(flag.Arg(0))
+	CACHE_ROOT = path.Clean(*cacheRoot)
+	processSlots = make(chan struct{}, *workers)
+	MAX_TRANSCODES = *transcodes
+	MAX_EXTRACT_BYTES = *extractMaxBytes
+	MAX_EXTRACT_ENTRIES = *extractMaxEntries
+	TRASH_ENABLED = *trashEnabled
+	TRASH_MAX_AGE = *trashMaxAge
+	TRASH_MAX_SIZE = *trashMaxSize
+	MAX_VERSIONS = *maxVersions
+	MAX_VERSION_AGE = *maxVersionAge
+
+	versionsPath := *versionsRoot
+	if versionsPath == "" {
+		versionsPath = filepath.Join(CACHE_ROOT, "versions")
+	}
+	versionsPath, err := filepath.Abs(versionsPath)
+	if err != nil {
+		panic(err)
+	}
+
+	// versions inside the root would be served and versioned themselves
+	if isUnderRoot(versionsPath) {
+		panic("The versions directory must be outside the root")
+	}
+	VERSIONS_ROOT = versionsPath
+	go cleanupVersions()
+
+	if *s3Addr != "" {
+		if *s3Keys == "" {
+			panic("-s3-keys is required to serve the S3 API")
+		}
+
+		keys, err := loadS3Keys(*s3Keys)
+		if err != nil {
+			panic(err)
+		}
+		S3_KEYS = keys
+	}
+
+	if *sftpAddr != "" {
+		if *sftpAuthorizedKeys == "" {
+			panic("-sftp-authorized-keys is required to serve SFTP")
+		}
+
+		// the key is a secret, so it can't be anywhere we'd serve it from
+		hostKeyPath := *sftpHostKey
+		if hostKeyPath == "" {
+			hostKeyPath = filepath.Join(CACHE_ROOT, "sftp_host_key")
+		}
+		hostKeyPath, err := filepath.Abs(hostKeyPath)
+		if err != nil {
+			panic(err)
+		}
+		if isUnderRoot(hostKeyPath) {
+			panic("The SFTP host key must be outside the root")
+		}
+
+		hostKey, err := loadSFTPHostKey(hostKeyPath)
+		if err != nil {
+			panic(err)
+		}
+
+		authorizedKeys, err := loadSFTPAuthorizedKeys(*sftpAuthorizedKeys)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Serving %s over SFTP to %s...\n", ROOT, *sftpAddr)
+		go func() {
+			log.Fatal(serveSFTP(*sftpAddr, hostKey, authorizedKeys))
+		}()
+	}
+
+	// stop transcoding videos nobody is watching any more
+	go cleanupHLSTranscodes()
+
+	// let go of things that have been in the trash too long
+	go cleanupTrash()
 
 	middlewares := alice.New(
 		loggingHandler,
-		handlers.CompressHandler,
+		compressHandler,
 		handlers.HTTPMethodOverrideHandler,
 	)
 
+	router := newRouter()
+
+	// the S3 API gets its own listener, since its paths would collide with ours
+	if *s3Addr != "" {
+		go cleanupS3Uploads()
+
+		fmt.Printf("Serving S3 API for %s to %s...\n", ROOT, *s3Addr)
+		go func() {
+			log.Fatal(http.ListenAndServe(*s3Addr, loggingHandler(http.HandlerFunc(serveS3))))
+		}()
+	}
+
+	addr := "127.0.0.1:3000"
+	fmt.Printf("Serving %s to %s...\n", ROOT, addr)
+	http.ListenAndServe(addr, middlewares.Then(router))
+}
+
+// builds the router that serves every one of our HTTP endpoints
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
 
 	// /files
@@ -545,10 +920,77 @@ func main() {
 	router.HandleFunc("/files/{path:.*}", download).
 		Methods("GET")
 
+	// /archive
+	router.HandleFunc("/archive", downloadArchive).
+		Methods("GET", "POST")
+
+	// /extract
+	router.HandleFunc("/extract", extractArchive).
+		Methods("POST")
+
+	// /dedupe
+	router.HandleFunc("/dedupe", dedupeFiles).
+		Methods("POST")
+
+	// /jobs
+	router.HandleFunc("/jobs/", getJobs).
+		Methods("GET")
+	router.HandleFunc("/jobs/{id}", getJob).
+		Methods("GET")
+
+	// /signatures and /deltas (delta syncing)
+	router.HandleFunc("/signatures/{path:.*[^/]$}", getSignature).
+		Methods("GET")
+	router.HandleFunc("/deltas/{path:.*[^/]$}", patchFile).
+		Methods("POST")
+
+	// /versions
+	router.HandleFunc("/versions/{path:.*[^/]$}", getVersions).
+		Methods("GET")
+	router.HandleFunc("/versions/{path:.*[^/]$}", restoreVersion).
+		Methods("POST")
+
+	// /trash
+	router.HandleFunc("/trash/", getTrash).
+		Methods("GET")
+	router.HandleFunc("/trash/", emptyTrash).
+		Methods("DELETE")
+	router.HandleFunc("/trash/{id}", restoreTrash).
+		Methods("POST")
+	router.HandleFunc("/trash/{id}", purgeTrashItem).
+		Methods("DELETE")
+
+	// /checksum
+	router.HandleFunc("/checksum/{path:.*[^/]$}", getChecksum).
+		Methods("GET")
+
 	// /thumbnails
 	router.HandleFunc("/thumbnails/{path:.*[^/]$}", getThumbnail).
 		Methods("GET")
 
+	// /previews
+	router.HandleFunc("/previews/{path:.*[^/]$}", getPreview).
+		Methods("GET")
+
+	// /metadata
+	router.HandleFunc("/metadata/{path:.*[^/]$}", getMetadata).
+		Methods("GET")
+
+	// /streams
+	router.HandleFunc("/streams/{path:.*[^/]$}", getStream).
+		Methods("GET")
+
+	// /audio
+	router.HandleFunc("/audio/{path:.*[^/]$}", getAudio).
+		Methods("GET")
+
+	// /image
+	router.HandleFunc("/image/{path:.*[^/]$}", getImage).
+		Methods("GET")
+
+	// /dav (WebDAV)
+	router.PathPrefix("/dav/").Handler(newDAVHandler("/dav"))
+
 	// /resources (static files)
 	router.HandleFunc("/resources/{path:.*}", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "ui/resources/"+mux.Vars(r)["path"])
@@ -559,7 +1001,5 @@ func main() {
 		http.ServeFile(w, r, "ui/resources/index.html")
 	}).Methods("GET")
 
-	addr := "127.0.0.1:3000"
-	fmt.Printf("Serving %s to %s...\n", ROOT, addr)
-	http.ListenAndServe(addr, middlewares.Then(router))
+	return router
 }
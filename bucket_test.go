@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serves everything out of memory storage for the length of a test,
+// returning the storage so the test can fill it.
+func useMemoryStorage(t testing.TB) *memoryStorage {
+	storage := newMemoryStorage("/bucket")
+
+	oldRoot, oldStorage, oldCacheRoot := ROOT, STORAGE, CACHE_ROOT
+	oldVersionsRoot, oldTrashEnabled, oldSymlinkPolicy := VERSIONS_ROOT, TRASH_ENABLED, SYMLINK_POLICY
+	t.Cleanup(func() {
+		ROOT, STORAGE, CACHE_ROOT = oldRoot, oldStorage, oldCacheRoot
+		VERSIONS_ROOT, TRASH_ENABLED, SYMLINK_POLICY = oldVersionsRoot, oldTrashEnabled, oldSymlinkPolicy
+	})
+
+	ROOT = "/bucket"
+	STORAGE = storage
+	CACHE_ROOT = t.TempDir()
+	VERSIONS_ROOT = ""
+	TRASH_ENABLED = false
+	SYMLINK_POLICY = symlinksRoot
+
+	return storage
+}
+
+// writes a file to storage, creating any directories it needs
+func writeTestFile(t testing.TB, storage Storage, name string, data []byte) {
+	t.Helper()
+
+	if err := storage.MkdirAll(filepath.Dir(name)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStorageFile(storage, name, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fails unless a file in storage exists with the given contents
+func expectTestFile(t *testing.T, storage Storage, name string, data string) {
+	t.Helper()
+	if contents, err := readStorageFile(storage, name); err != nil || string(contents) != data {
+		t.Errorf("expected %s to contain %q, got %q %v", name, data, contents, err)
+	}
+}
+
+// runs a request through the router, returning the recorded response
+func serveTestRequest(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	return w
+}
+
+// requests JSON for the given /files path
+func getTestJSON(t *testing.T, url string, v interface{}) int {
+	t.Helper()
+
+	r := httptest.NewRequest("GET", url, nil)
+	r.Header.Set("Content-Type", "application/json")
+	w := serveTestRequest(r)
+	if w.Code == 200 {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: %s", url, err)
+		}
+	}
+
+	return w.Code
+}
+
+func TestGetInfo(t *testing.T) {
+	storage := useMemoryStorage(t)
+	writeTestFile(t, storage, "/bucket/docs/notes.txt", []byte("hello"))
+
+	var info FileInfoJSON
+	if code := getTestJSON(t, "/files/docs/notes.txt", &info); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if info.Name != "notes.txt" || info.Size != 5 || info.IsDirectory || info.Version == "" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+
+	// the version changes with the file, even within the same second
+	writeTestFile(t, storage, "/bucket/docs/notes.txt", []byte("world"))
+	var changed FileInfoJSON
+	if code := getTestJSON(t, "/files/docs/notes.txt", &changed); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if changed.Version == info.Version {
+		t.Errorf("expected the version to change with the file, got %s both times", info.Version)
+	}
+
+	if code := getTestJSON(t, "/files/docs/missing.txt", &info); code != 404 {
+		t.Errorf("expected 404 for a missing file, got %d", code)
+	}
+}
+
+func TestGetDirectory(t *testing.T) {
+	storage := useMemoryStorage(t)
+	writeTestFile(t, storage, "/bucket/docs/b.txt", []byte("b"))
+	writeTestFile(t, storage, "/bucket/docs/a.txt", []byte("a"))
+	writeTestFile(t, storage, "/bucket/docs/sub/c.txt", []byte("c"))
+	writeTestFile(t, storage, "/bucket/"+trashDirName+"/old.txt", []byte("old"))
+	tempPath := tempPathIn("/bucket/docs", "delta")
+	writeTestFile(t, storage, tempPath, []byte("half written"))
+
+	var files []FileInfoJSON
+	if code := getTestJSON(t, "/files/docs/", &files); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	if len(names) != 3 || names[0] != "sub" || names[1] != "a.txt" || names[2] != "b.txt" {
+		t.Errorf("unexpected listing: %v", names)
+	}
+
+	// neither do temporary files, which can't be reached at all
+	if w := serveTestRequest(httptest.NewRequest("GET", "/files/docs/"+path.Base(tempPath), nil)); w.Code == 200 {
+		t.Errorf("expected temporary files to be unreachable")
+	}
+
+	// the trash never shows up in listings
+	if code := getTestJSON(t, "/files/", &files); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(files) != 1 || files[0].Name != "docs" {
+		t.Errorf("unexpected root listing: %+v", files)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	storage := useMemoryStorage(t)
+	writeTestFile(t, storage, "/bucket/docs/notes.txt", []byte("hello world"))
+
+	w := serveTestRequest(httptest.NewRequest("GET", "/files/docs/notes.txt", nil))
+	if w.Code != 200 || w.Body.String() != "hello world" {
+		t.Fatalf("unexpected response: %d %q", w.Code, w.Body.String())
+	}
+
+	r := httptest.NewRequest("GET", "/files/docs/notes.txt", nil)
+	r.Header.Set("Range", "bytes=6-")
+	w = serveTestRequest(r)
+	if w.Code != 206 || w.Body.String() != "world" {
+		t.Errorf("unexpected range response: %d %q", w.Code, w.Body.String())
+	}
+
+	w = serveTestRequest(httptest.NewRequest("GET", "/files/docs/missing.txt", nil))
+	if w.Code != 404 {
+		t.Errorf("expected 404 for a missing file, got %d", w.Code)
+	}
+}
+
+func TestFormatContentDisposition(t *testing.T) {
+	tests := []struct {
+		dispositionType string
+		name            string
+		value           string
+	}{
+		{dispositionAttachment, "notes.txt", `attachment; filename="notes.txt"`},
+		{dispositionInline, "notes.txt", `inline; filename="notes.txt"`},
+		{dispositionAttachment, "my notes.txt", `attachment; filename="my notes.txt"; filename*=UTF-8''my%20notes.txt`},
+		{dispositionAttachment, `say "hi".txt`, `attachment; filename="say \"hi\".txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{dispositionAttachment, `back\slash.txt`, `attachment; filename="back\\slash.txt"; filename*=UTF-8''back%5Cslash.txt`},
+		{dispositionAttachment, "a;b=c.txt", `attachment; filename="a;b=c.txt"; filename*=UTF-8''a%3Bb%3Dc.txt`},
+		{dispositionAttachment, "café.txt", `attachment; filename="caf_.txt"; filename*=UTF-8''caf%C3%A9.txt`},
+		{dispositionAttachment, "日本.txt", `attachment; filename="__.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.txt`},
+		{dispositionAttachment, "tab\there\r\n.txt", `attachment; filename="tab_here__.txt"; filename*=UTF-8''tab%09here%0D%0A.txt`},
+		{dispositionAttachment, "del\x7f.txt", `attachment; filename="del_.txt"; filename*=UTF-8''del%7F.txt`},
+	}
+
+	for _, test := range tests {
+		if value := formatContentDisposition(test.dispositionType, test.name); value != test.value {
+			t.Errorf("%q: expected %s, got %s", test.name, test.value, value)
+		}
+	}
+}
+
+func TestDownloadDisposition(t *testing.T) {
+	storage := useMemoryStorage(t)
+	writeTestFile(t, storage, "/bucket/docs/my notes.txt", []byte("hello"))
+
+	tests := []struct {
+		query string
+		code  int
+		value string
+	}{
+		{"", 200, `inline; filename="my notes.txt"; filename*=UTF-8''my%20notes.txt`},
+		{"?disposition=inline", 200, `inline; filename="my notes.txt"; filename*=UTF-8''my%20notes.txt`},
+		{"?disposition=attachment", 200, `attachment; filename="my notes.txt"; filename*=UTF-8''my%20notes.txt`},
+		{"?disposition=bogus", 400, ""},
+	}
+
+	for _, test := range tests {
+		w := serveTestRequest(httptest.NewRequest("GET", "/files/docs/my%20notes.txt"+test.query, nil))
+		if w.Code != test.code || w.Header().Get("Content-Disposition") != test.value {
+			t.Errorf("%q: unexpected response: %d %q", test.query, w.Code, w.Header().Get("Content-Disposition"))
+		}
+	}
+}
+
+func TestDownloadThroughSymlinks(t *testing.T) {
+	storage := useMemoryStorage(t)
+	writeTestFile(t, storage, "/bucket/docs/notes.txt", []byte("inside"))
+	writeTestFile(t, storage, "/outside/secret.txt", []byte("outside"))
+	if err := storage.Symlink("docs", "/bucket/inside"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Symlink("/outside", "/bucket/escape"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy string
+		url    string
+		body   string // empty if the request should fail
+	}{
+		{symlinksRoot, "/files/inside/notes.txt", "inside"},
+		{symlinksRoot, "/files/escape/secret.txt", ""},
+		{symlinksAny, "/files/escape/secret.txt", "outside"},
+		{symlinksNever, "/files/inside/notes.txt", ""},
+		{symlinksNever, "/files/docs/notes.txt", "inside"},
+	}
+
+	for _, test := range tests {
+		SYMLINK_POLICY = test.policy
+
+		w := serveTestRequest(httptest.NewRequest("GET", test.url, nil))
+		if test.body == "" && w.Code == 200 {
+			t.Errorf("%s %s: expected an error, got %q", test.policy, test.url, w.Body.String())
+		} else if test.body != "" && (w.Code != 200 || w.Body.String() != test.body) {
+			t.Errorf("%s %s: unexpected response: %d %q", test.policy, test.url, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestPathsAreDecodedOnce(t *testing.T) {
+	storage := useMemoryStorage(t)
+	writeTestFile(t, storage, "/bucket/notes..txt", []byte("notes"))
+	writeTestFile(t, storage, "/bucket/v1..v2.diff", []byte("diff"))
+	writeTestFile(t, storage, "/bucket/%2e%2e", []byte("encoded dots"))
+	writeTestFile(t, storage, "/bucket/%", []byte("percent"))
+	writeTestFile(t, storage, "/bucket/a+b.txt", []byte("plus"))
+	writeTestFile(t, storage, "/bucket/a b.txt", []byte("space"))
+	writeTestFile(t, storage, "/outside/secret.txt", []byte("outside"))
+
+	tests := []struct {
+		url  string
+		body string // empty if the request should fail
+	}{
+		{"/files/notes..txt", "notes"},
+		{"/files/v1..v2.diff", "diff"},
+		{"/files/%252e%252e", "encoded dots"},
+		{"/files/%25", "percent"},
+		{"/files/a+b.txt", "plus"},
+		{"/files/a%2Bb.txt", "plus"},
+		{"/files/a%20b.txt", "space"},
+		{"/files/%2e%2e/outside/secret.txt", ""},
+		{"/files/..%2foutside%2fsecret.txt", ""},
+		{"/files/%252e%252e/outside/secret.txt", ""},
+		{"/files/notes..txt%00", ""},
+		{"/files/notes..txt%0a", ""},
+	}
+
+	for _, test := range tests {
+		w := serveTestRequest(httptest.NewRequest("GET", test.url, nil))
+		if test.body == "" && w.Code == 200 {
+			t.Errorf("%s: expected an error, got %q", test.url, w.Body.String())
+		} else if test.body != "" && (w.Code != 200 || w.Body.String() != test.body) {
+			t.Errorf("%s: unexpected response: %d %q", test.url, w.Code, w.Body.String())
+		}
+	}
+}
+
+// returns where a path in memory storage leads once every link along it is
+// followed, including a broken one at the end, since that's where anything
+// created at the path would go. whatever doesn't exist is kept as it is.
+func resolveTestPath(storage *memoryStorage, name string) string {
+	storage.RLock()
+	defer storage.RUnlock()
+
+	resolved := "/"
+	pending := strings.Split(name, "/")
+	for links := 0; len(pending) > 0 && links <= 40; {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		file, ok := storage.files[next]
+		if !ok {
+			// nothing below something that doesn't exist can be a link
+			return path.Join(append([]string{next}, pending...)...)
+		}
+		if file.mode&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if path.IsAbs(file.linkDest) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(file.linkDest, "/"), pending...)
+	}
+
+	return resolved
+}
+
+// returns whether a path is the root or anything under it
+func testPathUnderRoot(name string) bool {
+	relPath, err := filepath.Rel(ROOT, name)
+	return err == nil && !relPathEscapes(relPath)
+}
+
+func FuzzNormalizePathUnderRoot(f *testing.F) {
+	storage := useMemoryStorage(f)
+	writeTestFile(f, storage, "/bucket/docs/notes.txt", []byte("inside"))
+	writeTestFile(f, storage, "/outside/secret.txt", []byte("outside"))
+	links := []struct{ name, dest string }{
+		{"/bucket/inside", "docs"},
+		{"/bucket/docs/back", ".."},
+		{"/bucket/docs/self", "../docs/notes.txt"},
+		{"/bucket/up", ".."},
+		{"/bucket/escape", "/outside"},
+		{"/bucket/docs/rel", "../../outside/secret.txt"},
+		{"/bucket/docs/deep", "back/back/../.."},
+		{"/bucket/dangling", "/outside/missing.txt"},
+		{"/bucket/dangling-inside", "docs/missing.txt"},
+		{"/bucket/chain", "dangling"},
+		{"/bucket/chain-inside", "dangling-inside"},
+		{"/bucket/loop", "loop"},
+	}
+	for _, link := range links {
+		if err := storage.Symlink(link.dest, link.name); err != nil {
+			f.Fatal(err)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, child string) {
+		for _, policy := range []string{symlinksRoot, symlinksAny, symlinksNever} {
+			SYMLINK_POLICY = policy
+
+			normalizedPath, err := normalizePathUnderRoot(ROOT, child)
+			if err != nil {
+				continue
+			}
+
+			if !testPathUnderRoot(normalizedPath) {
+				t.Fatalf("%s: %q became %q, outside the root", policy, child, normalizedPath)
+			}
+
+			// following links is only limited when the policy says so
+			resolvedPath := resolveTestPath(storage, normalizedPath)
+			switch policy {
+			case symlinksRoot:
+				if !testPathUnderRoot(resolvedPath) {
+					t.Fatalf("%s: %q became %q, which leads to %q outside the root", policy, child, normalizedPath, resolvedPath)
+				}
+			case symlinksNever:
+				if resolvedPath != normalizedPath {
+					t.Fatalf("%s: %q became %q, which follows links to %q", policy, child, normalizedPath, resolvedPath)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// the directory generated files (thumbnails, previews, etc.) are cached in
+var CACHE_ROOT = ""
+
+// given the full path to a file, its info, and any parameters that affect the
+// generated output, returns a key that uniquely identifies that output for
+// this particular version of the file. if the file changes size or gets
+// modified, the key changes too, so stale entries are never served.
+func cacheKey(filePath string, file os.FileInfo, params ...string) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d", filePath, file.Size(), file.ModTime().UnixNano())
+	for _, param := range params {
+		fmt.Fprintf(h, "\x00%s", param)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// returns the on-disk location for the given cache key. entries are split into
+// sub-directories by key prefix so no single directory grows too large.
+func cachePath(key string) string {
+	return filepath.Join(CACHE_ROOT, key[:2], key)
+}
+
+// returns the cached data for the given key, and whether it was found
+func readCache(key string) ([]byte, bool) {
+	data, err := ioutil.ReadFile(cachePath(key))
+	if err != nil {
+		return nil, false
+	}
+
+	return data, true
+}
+
+// stores data under the given key. the data is written to a temporary file
+// first and moved into place afterwards so concurrent readers never see a
+// partially-written entry.
+func writeCache(key string, data []byte) error {
+	f, err := createCacheEntry(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	return commitCacheEntry(key, f, err)
+}
+
+// starts writing a cache entry that's too large to hold in memory. the entry
+// is written to a temporary file, and only moved into place under its key by
+// commitCacheEntry.
+func createCacheEntry(key string) (*os.File, error) {
+	entryPath := cachePath(key)
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0755); err != nil {
+		return nil, err
+	}
+
+	return ioutil.TempFile(filepath.Dir(entryPath), key+".tmp")
+}
+
+// finishes a cache entry started by createCacheEntry, or throws it away if
+// writing it failed with the given error.
+func commitCacheEntry(key string, f *os.File, err error) error {
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), cachePath(key))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"lukechampine.com/blake3"
+)
+
+// the hashes we can compute for a file, by the name clients ask for them with
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// the names of the algorithms above that can be sent in a `Digest` header, per
+// RFC 3230. the others have no registered name.
+var digestNames = map[string]string{
+	"sha256": "SHA-256",
+	"sha1":   "SHA",
+	"md5":    "MD5",
+}
+
+type ChecksumJSON struct {
+	Algorithm string `json:"algorithm"`
+	Hex       string `json:"hex"`
+	Base64    string `json:"base64"`
+}
+
+// returns the key a file's checksum is cached under
+func checksumCacheKey(filePath string, file os.FileInfo, algo string) string {
+	return cacheKey(filePath, file, "checksum", algo)
+}
+
+// returns a file's checksum using the given algorithm, reading it from the
+// cache if we've computed it before.
+func fileChecksum(filePath string, file os.FileInfo, algo string) ([]byte, error) {
+	key := checksumCacheKey(filePath, file, algo)
+	if sum, ok := readCache(key); ok {
+		return sum, nil
+	}
+
+	f, err := STORAGE.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := checksumAlgorithms[algo]()
+	if _, err := io.Copy(h, bufio.NewReader(f)); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+
+	// failing to cache isn't fatal, we'll just have to compute it again later
+	writeCache(key, sum)
+	return sum, nil
+}
+
+// returns the checksum of a file. the `algo` parameter picks the algorithm,
+// and defaults to `sha256`.
+func getChecksum(w http.ResponseWriter, r *http.Request) {
+	rawPath := mux.Vars(r)["path"]
+	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	algo := strings.ToLower(r.URL.Query().Get("algo"))
+	if algo == "" {
+		algo = "sha256"
+	}
+	if _, ok := checksumAlgorithms[algo]; !ok {
+		http.Error(w, "Unsupported algorithm: "+algo, 400)
+		return
+	}
+
+	file, err := STORAGE.Stat(normalizedPath)
+	if err != nil || !file.Mode().IsRegular() {
+		// don't report the raw error in case we leak server directory information
+		http.Error(w, "Could not find "+rawPath, 404)
+		return
+	}
+
+	sum, err := fileChecksum(normalizedPath, file, algo)
+	if err != nil {
+		http.Error(w, "Could not read "+rawPath, 500)
+		return
+	}
+
+	writeJSONResponse(w, ChecksumJSON{
+		algo,
+		hex.EncodeToString(sum),
+		base64.StdEncoding.EncodeToString(sum),
+	})
+}
+
+// adds a `Digest` header for every checksum of the file we've already
+// computed. computing them here would make every download read the file twice.
+func addDigestHeader(w http.ResponseWriter, filePath string, file os.FileInfo) {
+	digests := []string{}
+	for algo, name := range digestNames {
+		if sum, ok := readCache(checksumCacheKey(filePath, file, algo)); ok {
+			digests = append(digests, name+"="+base64.StdEncoding.EncodeToString(sum))
+		}
+	}
+
+	if len(digests) > 0 {
+		sort.Strings(digests)
+		w.Header().Set("Digest", strings.Join(digests, ","))
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetChecksum(t *testing.T) {
+	storage := useMemoryStorage(t)
+	writeTestFile(t, storage, "/bucket/abc.txt", []byte("abc"))
+
+	tests := []struct {
+		query string
+		algo  string
+		hex   string
+	}{
+		{"", "sha256", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"?algo=sha256", "sha256", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"?algo=SHA1", "sha1", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{"?algo=md5", "md5", "900150983cd24fb0d6963f7d28e17f72"},
+		{"?algo=blake3", "blake3", "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{"?algo=crc32", "crc32", "352441c2"},
+	}
+
+	for _, test := range tests {
+		var checksum ChecksumJSON
+		if code := getTestJSON(t, "/checksum/abc.txt"+test.query, &checksum); code != 200 {
+			t.Errorf("%q: expected 200, got %d", test.query, code)
+			continue
+		}
+
+		sum, _ := hex.DecodeString(test.hex)
+		if checksum.Algorithm != test.algo || checksum.Hex != test.hex || checksum.Base64 != base64.StdEncoding.EncodeToString(sum) {
+			t.Errorf("%q: unexpected checksum %+v", test.query, checksum)
+		}
+	}
+
+	var checksum ChecksumJSON
+	if code := getTestJSON(t, "/checksum/abc.txt?algo=sha512", &checksum); code != 400 {
+		t.Errorf("expected 400 for an unsupported algorithm, got %d", code)
+	}
+	if code := getTestJSON(t, "/checksum/missing.txt", &checksum); code != 404 {
+		t.Errorf("expected 404 for a missing file, got %d", code)
+	}
+}
+
+func TestChecksumsAreCached(t *testing.T) {
+	storage := useMemoryStorage(t)
+	writeTestFile(t, storage, "/bucket/abc.txt", []byte("abc"))
+
+	// whatever's cached for this version of the file is what we get back
+	file, err := storage.Stat("/bucket/abc.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCache(checksumCacheKey("/bucket/abc.txt", file, "sha256"), []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	var checksum ChecksumJSON
+	if code := getTestJSON(t, "/checksum/abc.txt", &checksum); code != 200 || checksum.Hex != "010203" {
+		t.Errorf("expected the cached checksum, got %d %+v", code, checksum)
+	}
+
+	// but a new version of the file gets a new one
+	writeTestFile(t, storage, "/bucket/abc.txt", []byte("abc"))
+	if code := getTestJSON(t, "/checksum/abc.txt", &checksum); code != 200 || checksum.Hex != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("expected the checksum to be computed again, got %d %+v", code, checksum)
+	}
+}
+
+func TestDigestHeader(t *testing.T) {
+	storage := useMemoryStorage(t)
+	writeTestFile(t, storage, "/bucket/abc.txt", []byte("abc"))
+
+	digest := func() string {
+		w := serveTestRequest(httptest.NewRequest("GET", "/files/abc.txt", nil))
+		if w.Code != 200 {
+			t.Fatalf("unexpected response: %d %s", w.Code, w.Body.String())
+		}
+		return w.Header().Get("Digest")
+	}
+
+	// nothing's been computed, and downloading doesn't compute anything
+	if value := digest(); value != "" {
+		t.Errorf("expected no Digest header before any checksums are computed, got %s", value)
+	}
+
+	// algorithms without a registered name never show up
+	var checksum ChecksumJSON
+	getTestJSON(t, "/checksum/abc.txt?algo=blake3", &checksum)
+	getTestJSON(t, "/checksum/abc.txt?algo=crc32", &checksum)
+	if value := digest(); value != "" {
+		t.Errorf("expected no Digest header for unregistered algorithms, got %s", value)
+	}
+
+	getTestJSON(t, "/checksum/abc.txt?algo=sha256", &checksum)
+	if value := digest(); value != "SHA-256=ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=" {
+		t.Errorf("unexpected Digest header %s", value)
+	}
+
+	getTestJSON(t, "/checksum/abc.txt?algo=md5", &checksum)
+	if value := digest(); value != "MD5=kAFQmDzST7DWlj99KOF/cg==,SHA-256=ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=" {
+		t.Errorf("unexpected Digest header %s", value)
+	}
+
+	// and they're forgotten once the file changes
+	writeTestFile(t, storage, "/bucket/abc.txt", []byte("abd"))
+	if value := digest(); value != "" {
+		t.Errorf("expected no Digest header for a changed file, got %s", value)
+	}
+}
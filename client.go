@@ -0,0 +1,841 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// a subcommand of the command-line client
+type clientCommand struct {
+	Usage       string
+	Description string
+	Run         func(c *client, flags *flag.FlagSet, args []string) error
+}
+
+// every subcommand the client understands, by name
+var clientCommands = map[string]clientCommand{
+	"ls":     {"ls [path]", "list a directory", runClientLs},
+	"stat":   {"stat <path>", "show information about a file or directory", runClientStat},
+	"get":    {"get [-r] <path> [local path]", "download a file, or a directory with -r", runClientGet},
+	"put":    {"put [-r] <local path> <path>", "upload a file, or a directory with -r", runClientPut},
+	"mkdir":  {"mkdir [-p] <path>", "create a directory", runClientMkdir},
+	"mv":     {"mv <path> <new path>", "move or rename a file or directory", runClientMv},
+	"rm":     {"rm [-r] <path>", "remove a file, or a directory with -r", runClientRm},
+	"search": {"search <pattern> [path]", "find files whose names match a pattern", runClientSearch},
+	"share":  {"share <path>", "print a link others can download a file from", runClientShare},
+	"sync":   {"sync [-delete | -watch] <local dir> <path>", "mirror a local directory, or keep both in sync with -watch", runClientSync},
+}
+
+// talks to a running server on behalf of the command-line client
+type client struct {
+	server    string // base URL of the server, without a trailing `/`
+	format    string // how to print results: `text` or `json`
+	quiet     bool   // whether to hide progress
+	recursive bool
+	parents   bool
+	delete    bool
+	watch     bool
+	interval  time.Duration
+}
+
+// runs the command-line client if the arguments name one of its subcommands,
+// returning false otherwise so we can start the server as usual.
+func runClient(args []string) bool {
+	if len(args) < 1 {
+		return false
+	}
+
+	command, ok := clientCommands[args[0]]
+	if !ok {
+		return false
+	}
+
+	c := &client{}
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	flags.StringVar(&c.server, "server", "http://127.0.0.1:3000",
+		"URL of the server to talk to (defaults to $BUCKET_SERVER if set)")
+	flags.StringVar(&c.format, "format", "text", "output format: text or json")
+	flags.BoolVar(&c.quiet, "q", false, "don't show progress (it's only shown on a terminal anyway)")
+	flags.BoolVar(&c.recursive, "r", false, "include everything under directories")
+	flags.BoolVar(&c.parents, "p", false, "create missing parent directories")
+	flags.BoolVar(&c.delete, "delete", false, "remove anything on the server that isn't in the local directory")
+	flags.BoolVar(&c.watch, "watch", false, "keep syncing changes in both directions until stopped")
+	flags.DurationVar(&c.interval, "interval", 30*time.Second, "how often to check the server for changes with -watch")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: bucket %s\n\n%s\n\n", command.Usage, command.Description)
+		flags.PrintDefaults()
+	}
+
+	if server := os.Getenv("BUCKET_SERVER"); server != "" {
+		c.server = server
+	}
+	flags.Parse(args[1:])
+
+	// progress is only for people watching, not for scripts
+	if stderr, err := os.Stderr.Stat(); err != nil || stderr.Mode()&os.ModeCharDevice == 0 {
+		c.quiet = true
+	}
+	c.server = strings.TrimRight(c.server, "/")
+
+	if c.format != "text" && c.format != "json" {
+		fmt.Fprintf(os.Stderr, "bucket: unsupported format: %s\n", c.format)
+		os.Exit(2)
+	}
+
+	if err := command.Run(c, flags, flags.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "bucket %s: %s\n", args[0], err)
+		os.Exit(1)
+	}
+
+	return true
+}
+
+// prints the usage of every subcommand
+func printClientUsage() {
+	names := []string{}
+	for name := range clientCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "\nclient commands (run `bucket <command> -h` for details):\n")
+	for _, name := range names {
+		command := clientCommands[name]
+		fmt.Fprintf(os.Stderr, "  bucket %-32s %s\n", command.Usage, command.Description)
+	}
+}
+
+// returns the URL for a path under the given route, escaping each segment
+func (c *client) url(route string, filePath string) string {
+	segments := strings.Split(strings.Trim(filePath, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return c.server + route + strings.Join(segments, "/")
+}
+
+// sends a request, returning an error made from the response body if the
+// server didn't succeed.
+func (c *client) do(req *http.Request) (*http.Response, error) {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		if len(strings.TrimSpace(string(message))) == 0 {
+			message = []byte(res.Status)
+		}
+		return nil, fmt.Errorf("%s", strings.TrimSpace(string(message)))
+	}
+
+	return res, nil
+}
+
+// fetches JSON from one of the /files routes, which only return it when
+// asked for explicitly.
+func (c *client) getJSON(filePath string, isDir bool, v interface{}) error {
+	fileURL := c.url("/files/", filePath)
+	if isDir && !strings.HasSuffix(fileURL, "/") {
+		fileURL += "/"
+	}
+
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// returns information about a single file or directory
+func (c *client) stat(filePath string) (FileInfoJSON, error) {
+	var info FileInfoJSON
+	if strings.Trim(filePath, "/") == "" {
+		// the root has no name to ask for, but it's always a directory
+		return FileInfoJSON{Name: "/", IsDirectory: true}, nil
+	}
+
+	err := c.getJSON(filePath, false, &info)
+	return info, err
+}
+
+// returns the contents of a directory
+func (c *client) list(dirPath string) ([]FileInfoJSON, error) {
+	var files []FileInfoJSON
+	err := c.getJSON(dirPath, true, &files)
+	return files, err
+}
+
+// sends a WebDAV request, which is how we change things on the server
+func (c *client) dav(method string, filePath string, body io.Reader, header http.Header) error {
+	req, err := http.NewRequest(method, c.url("/dav/", filePath), body)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// prints a value in the requested format, using the given function for text
+func (c *client) print(v interface{}, text func(w io.Writer)) {
+	if c.format == "json" {
+		out, _ := json.MarshalIndent(v, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	text(w)
+	w.Flush()
+}
+
+// prints files one per line, `ls -l` style
+func printFileInfos(w io.Writer, files []FileInfoJSON, names []string) {
+	for i, file := range files {
+		kind := "-"
+		if file.IsLink {
+			kind = "l"
+		} else if file.IsDirectory {
+			kind = "d"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", kind, formatSize(file.Size), file.ModifiedAt, names[i])
+	}
+}
+
+// formats a size in bytes for humans
+func formatSize(size int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// reports how much of a transfer is done as it happens
+type progressReader struct {
+	r       io.Reader
+	name    string
+	total   int64
+	done    int64
+	quiet   bool
+	printed time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+
+	// don't flood the terminal with updates
+	if !p.quiet && time.Since(p.printed) > 100*time.Millisecond {
+		p.printed = time.Now()
+		if p.total > 0 {
+			fmt.Fprintf(os.Stderr, "\r\x1b[K%s  %s / %s (%d%%)", p.name, formatSize(p.done), formatSize(p.total), 100*p.done/p.total)
+		} else {
+			fmt.Fprintf(os.Stderr, "\r\x1b[K%s  %s", p.name, formatSize(p.done))
+		}
+	}
+	return n, err
+}
+
+// replaces the progress line with a summary once the transfer is over
+func (p *progressReader) finish() {
+	if !p.quiet {
+		fmt.Fprintf(os.Stderr, "\r\x1b[K%s  %s\n", p.name, formatSize(p.done))
+	}
+}
+
+func runClientLs(c *client, flags *flag.FlagSet, args []string) error {
+	dirPath := "/"
+	if len(args) > 0 {
+		dirPath = args[0]
+	}
+
+	files, err := c.list(dirPath)
+	if err != nil {
+		return err
+	}
+
+	c.print(files, func(w io.Writer) {
+		names := make([]string, len(files))
+		for i, file := range files {
+			names[i] = file.Name
+			if file.IsDirectory {
+				names[i] += "/"
+			}
+			if file.LinkTarget != "" {
+				names[i] += " -> " + file.LinkTarget
+			}
+		}
+		printFileInfos(w, files, names)
+	})
+	return nil
+}
+
+func runClientStat(c *client, flags *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	info, err := c.stat(args[0])
+	if err != nil {
+		return err
+	}
+
+	c.print(info, func(w io.Writer) {
+		fmt.Fprintf(w, "name:\t%s\n", info.Name)
+		fmt.Fprintf(w, "size:\t%d\n", info.Size)
+		fmt.Fprintf(w, "modified:\t%s\n", info.ModifiedAt)
+		fmt.Fprintf(w, "type:\t%s\n", info.MIMEType)
+		fmt.Fprintf(w, "directory:\t%t\n", info.IsDirectory)
+		fmt.Fprintf(w, "link:\t%t\n", info.IsLink)
+		if info.IsLink {
+			fmt.Fprintf(w, "link target:\t%s\n", info.LinkTarget)
+			fmt.Fprintf(w, "broken link:\t%t\n", info.IsBrokenLink)
+		}
+	})
+	return nil
+}
+
+// downloads a single file to the given local path
+func (c *client) getFile(filePath string, localPath string) error {
+	req, err := http.NewRequest("GET", c.url("/files/", filePath), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// download next to where the file is going so a failure leaves nothing
+	// half-written behind.
+	f, err := ioutil.TempFile(filepath.Dir(localPath), ".bucket-download")
+	if err != nil {
+		return err
+	}
+
+	progress := &progressReader{r: res.Body, name: filePath, total: res.ContentLength, quiet: c.quiet}
+	_, err = io.Copy(f, progress)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), localPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	progress.finish()
+	return nil
+}
+
+// downloads a directory and everything under it to the given local path
+func (c *client) getTree(dirPath string, localPath string) error {
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return err
+	}
+
+	files, err := c.list(dirPath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		childPath := path.Join(dirPath, file.Name)
+		childLocalPath := filepath.Join(localPath, file.Name)
+
+		// links to directories could lead us around in circles forever
+		if file.IsLink && (file.IsDirectory || file.IsBrokenLink) {
+			continue
+		}
+
+		if file.IsDirectory {
+			err = c.getTree(childPath, childLocalPath)
+		} else {
+			err = c.getFile(childPath, childLocalPath)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", childPath, err)
+		}
+	}
+
+	return nil
+}
+
+func runClientGet(c *client, flags *flag.FlagSet, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	info, err := c.stat(args[0])
+	if err != nil {
+		return err
+	}
+
+	localPath := path.Base("/" + strings.Trim(args[0], "/"))
+	if localPath == "/" {
+		localPath = "files"
+	}
+	if len(args) == 2 {
+		localPath = args[1]
+
+		// downloading into a directory keeps the file's own name
+		if local, err := os.Stat(localPath); err == nil && local.IsDir() {
+			localPath = filepath.Join(localPath, info.Name)
+		}
+	}
+
+	if info.IsDirectory {
+		if !c.recursive {
+			return fmt.Errorf("%s is a directory (use -r to download it)", args[0])
+		}
+		return c.getTree(args[0], localPath)
+	}
+
+	return c.getFile(args[0], localPath)
+}
+
+// uploads a single local file to the given path
+func (c *client) putFile(localPath string, filePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	local, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	progress := &progressReader{r: f, name: filePath, total: local.Size(), quiet: c.quiet}
+	req, err := http.NewRequest("PUT", c.url("/dav/", filePath), progress)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = local.Size()
+
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	progress.finish()
+	return nil
+}
+
+// creates a directory, succeeding if it already exists
+func (c *client) mkdir(dirPath string) error {
+	err := c.dav("MKCOL", dirPath, nil, nil)
+	if err != nil {
+		// WebDAV refuses to create a directory that's already there
+		if info, statErr := c.stat(dirPath); statErr == nil && info.IsDirectory {
+			return nil
+		}
+	}
+	return err
+}
+
+func runClientPut(c *client, flags *flag.FlagSet, args []string) error {
+	if len(args) != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	localPath, filePath := args[0], args[1]
+
+	local, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	// uploading into a directory keeps the file's own name
+	if strings.HasSuffix(filePath, "/") {
+		filePath = path.Join(filePath, filepath.Base(localPath))
+	} else if info, err := c.stat(filePath); err == nil && info.IsDirectory {
+		filePath = path.Join(filePath, filepath.Base(localPath))
+	}
+
+	if !local.IsDir() {
+		return c.putFile(localPath, filePath)
+	}
+
+	if !c.recursive {
+		return fmt.Errorf("%s is a directory (use -r to upload it)", localPath)
+	}
+
+	return filepath.Walk(localPath, func(fullPath string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, _ := filepath.Rel(localPath, fullPath)
+		childPath := path.Join(filePath, filepath.ToSlash(relPath))
+
+		if file.IsDir() {
+			err = c.mkdir(childPath)
+		} else if file.Mode().IsRegular() {
+			err = c.putFile(fullPath, childPath)
+		} else if !c.quiet {
+			fmt.Fprintf(os.Stderr, "skipping %s: not a regular file\n", fullPath)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", childPath, err)
+		}
+		return nil
+	})
+}
+
+func runClientMkdir(c *client, flags *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if !c.parents {
+		return c.dav("MKCOL", args[0], nil, nil)
+	}
+
+	// create each directory along the way in turn
+	dirPath := ""
+	for _, segment := range strings.Split(strings.Trim(args[0], "/"), "/") {
+		dirPath = path.Join(dirPath, segment)
+		if err := c.mkdir(dirPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runClientMv(c *client, flags *flag.FlagSet, args []string) error {
+	if len(args) != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// never replace anything, the same as `mv -n`
+	return c.dav("MOVE", args[0], nil, http.Header{
+		"Destination": {c.url("/dav/", args[1])},
+		"Overwrite":   {"F"},
+	})
+}
+
+func runClientRm(c *client, flags *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// WebDAV deletes directories along with everything in them, so make sure
+	// that's really what was asked for.
+	info, err := c.stat(args[0])
+	if err != nil {
+		return err
+	}
+	if info.IsDirectory && !c.recursive {
+		return fmt.Errorf("%s is a directory (use -r to remove it)", args[0])
+	}
+
+	return c.dav("DELETE", args[0], nil, nil)
+}
+
+// a file found by searching
+type clientSearchResult struct {
+	Path string `json:"path"`
+	FileInfoJSON
+}
+
+func runClientSearch(c *client, flags *flag.FlagSet, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// patterns without any wildcards match anywhere in the name
+	pattern := strings.ToLower(args[0])
+	if !strings.ContainsAny(pattern, "*?[") {
+		pattern = "*" + pattern + "*"
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern: %s", args[0])
+	}
+
+	dirPath := "/"
+	if len(args) == 2 {
+		dirPath = args[1]
+	}
+
+	// NOTE: the server has no search of its own, so we walk the tree ourselves
+	results := []clientSearchResult{}
+	var search func(dirPath string) error
+	search = func(dirPath string) error {
+		files, err := c.list(dirPath)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			childPath := path.Join(dirPath, file.Name)
+			if matched, _ := path.Match(pattern, strings.ToLower(file.Name)); matched {
+				results = append(results, clientSearchResult{childPath, file})
+			}
+
+			if file.IsDirectory && !file.IsLink {
+				if err := search(childPath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := search(dirPath); err != nil {
+		return err
+	}
+
+	c.print(results, func(w io.Writer) {
+		files := make([]FileInfoJSON, len(results))
+		names := make([]string, len(results))
+		for i, result := range results {
+			files[i] = result.FileInfoJSON
+			names[i] = result.Path
+		}
+		printFileInfos(w, files, names)
+	})
+	return nil
+}
+
+func runClientShare(c *client, flags *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if _, err := c.stat(args[0]); err != nil {
+		return err
+	}
+
+	// NOTE: the server has no access control, so a file's own download URL is
+	// all anyone needs to fetch it.
+	link := c.url("/files/", args[0])
+	c.print(map[string]string{"url": link}, func(w io.Writer) {
+		fmt.Fprintln(w, link)
+	})
+	return nil
+}
+
+// brings a file on the server up to date with a local one, sending only the
+// blocks that differ from what's already there.
+func (c *client) syncFile(localPath string, filePath string) error {
+	// start from nothing if the file isn't on the server yet
+	signature := SignatureJSON{BlockSize: minDeltaBlockSize}
+	if info, err := c.stat(filePath); err == nil {
+		if info.IsDirectory {
+			return fmt.Errorf("a directory is in the way")
+		}
+
+		req, err := http.NewRequest("GET", c.url("/signatures/", filePath), nil)
+		if err != nil {
+			return err
+		}
+		res, err := c.do(req)
+		if err != nil {
+			return err
+		}
+		err = json.NewDecoder(res.Body).Decode(&signature)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// work out the delta up front, since we need the file's hash before we can
+	// send it. this only takes as much space as the changes do.
+	delta, err := ioutil.TempFile("", "bucket-delta")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(delta.Name())
+	defer delta.Close()
+
+	stats, err := writeDelta(bufio.NewReader(f), signature, delta)
+	if err != nil {
+		return err
+	}
+	// a new file always has to be sent, even if it's as empty as the nothing
+	// we compared it against.
+	if stats.Unchanged && signature.Version != "" {
+		return nil
+	}
+	if _, err := delta.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("base", signature.Version)
+	query.Set("block_size", strconv.Itoa(signature.BlockSize))
+	query.Set("sha256", stats.SHA256)
+
+	size, _ := delta.Seek(0, io.SeekEnd)
+	delta.Seek(0, io.SeekStart)
+	progress := &progressReader{r: delta, name: filePath, total: size, quiet: c.quiet}
+	req, err := http.NewRequest("POST", c.url("/deltas/", filePath)+"?"+query.Encode(), progress)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if !c.quiet {
+		fmt.Fprintf(os.Stderr, "\r\x1b[K%s  sent %s, reused %s\n", filePath, formatSize(stats.LiteralBytes), formatSize(stats.CopiedBytes))
+	}
+	return nil
+}
+
+// removes everything under a directory on the server that has no counterpart
+// under the local directory.
+func (c *client) deleteExtra(localPath string, dirPath string) error {
+	files, err := c.list(dirPath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		childPath := path.Join(dirPath, file.Name)
+		childLocalPath := filepath.Join(localPath, file.Name)
+
+		local, err := os.Lstat(childLocalPath)
+		switch {
+		case err != nil || local.IsDir() != file.IsDirectory:
+			if !c.quiet {
+				fmt.Fprintf(os.Stderr, "removing %s\n", childPath)
+			}
+			err = c.dav("DELETE", childPath, nil, nil)
+		case file.IsDirectory && !file.IsLink:
+			err = c.deleteExtra(childLocalPath, childPath)
+		default:
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", childPath, err)
+		}
+	}
+
+	return nil
+}
+
+func runClientSync(c *client, flags *flag.FlagSet, args []string) error {
+	if len(args) != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	localPath, dirPath := args[0], args[1]
+
+	local, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if !local.IsDir() {
+		return fmt.Errorf("%s is not a directory", localPath)
+	}
+
+	if c.watch {
+		if c.interval <= 0 {
+			return fmt.Errorf("the interval must be positive")
+		}
+		if err := c.mkdir(dirPath); err != nil {
+			return err
+		}
+
+		s := &twoWaySync{c: c, localRoot: localPath, remoteRoot: dirPath}
+		return s.run(c.interval)
+	}
+
+	// clear out anything that's gone first, so it can't get in the way of new
+	// files with the same names.
+	if c.delete {
+		if err := c.deleteExtra(localPath, dirPath); err != nil {
+			return err
+		}
+	}
+
+	return filepath.Walk(localPath, func(fullPath string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, _ := filepath.Rel(localPath, fullPath)
+		childPath := path.Join(dirPath, filepath.ToSlash(relPath))
+
+		if file.IsDir() {
+			err = c.mkdir(childPath)
+		} else if file.Mode().IsRegular() {
+			err = c.syncFile(fullPath, childPath)
+		} else if !c.quiet {
+			fmt.Fprintf(os.Stderr, "skipping %s: not a regular file\n", fullPath)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", childPath, err)
+		}
+		return nil
+	})
+}
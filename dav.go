@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/webdav"
+)
+
+// a WebDAV file system that serves the root, confining every path to it using
+// the same rules as the rest of our handlers.
+type rootFileSystem struct{}
+
+// maps a WebDAV path to the real path under the root
+func (rootFileSystem) resolve(name string) (string, error) {
+	normalizedPath, err := normalizePathUnderRoot(ROOT, name)
+	if err != nil {
+		return "", os.ErrNotExist
+	}
+
+	return normalizedPath, nil
+}
+
+func (fs rootFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	normalizedPath, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+
+	return STORAGE.Mkdir(normalizedPath)
+}
+
+func (fs rootFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	normalizedPath, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// reading only needs storage
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		file, err := STORAGE.Stat(normalizedPath)
+		if err != nil {
+			return nil, err
+		}
+		if file.IsDir() {
+			return &davFile{name: normalizedPath}, nil
+		}
+
+		f, err := STORAGE.Open(normalizedPath)
+		if err != nil {
+			return nil, err
+		}
+		return &davFile{StorageFile: f, name: normalizedPath}, nil
+	}
+
+	// WebDAV can write anywhere in a file, which needs a real one
+	filePath, err := localPath(normalizedPath)
+	if err != nil {
+		return nil, os.ErrPermission
+	}
+
+	// keep whatever we're about to overwrite
+	if flag&os.O_TRUNC != 0 {
+		if err := saveVersion(normalizedPath); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := openRewrittenFile(filePath, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &davFile{StorageFile: f, name: normalizedPath, w: f}, nil
+}
+
+// a file or directory served over WebDAV. directory listings come from
+// storage, and hide the trash and temporary files.
+type davFile struct {
+	StorageFile // nil for directories
+	name        string
+	w           io.Writer // nil unless the file was opened for writing
+
+	// the rest of the directory's contents, once listing it has started
+	children []os.FileInfo
+	listed   bool
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.StorageFile == nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: fmt.Errorf("Is a directory")}
+	}
+	return f.StorageFile.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.StorageFile == nil {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: fmt.Errorf("Is a directory")}
+	}
+	return f.StorageFile.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if f.w == nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	return f.w.Write(p)
+}
+
+func (f *davFile) Close() error {
+	if f.StorageFile == nil {
+		return nil
+	}
+	return f.StorageFile.Close()
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	// a file being rewritten isn't in place until it's closed
+	if w, ok := f.w.(*rewrittenFile); ok {
+		file, err := w.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return namedFileInfo{file, filepath.Base(f.name)}, nil
+	}
+
+	return STORAGE.Stat(f.name)
+}
+
+// file info under a name other than the one the file has right now
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (f namedFileInfo) Name() string { return f.name }
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.listed {
+		children, err := STORAGE.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, child := range children {
+			if !isReservedName(child.Name()) {
+				f.children = append(f.children, child)
+			}
+		}
+		f.listed = true
+	}
+
+	// like os.File, return everything that's left unless asked for less
+	if count <= 0 {
+		children := f.children
+		f.children = nil
+		return children, nil
+	}
+	if len(f.children) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.children) {
+		count = len(f.children)
+	}
+	children := f.children[:count]
+	f.children = f.children[count:]
+	return children, nil
+}
+
+func (fs rootFileSystem) RemoveAll(ctx context.Context, name string) error {
+	normalizedPath, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+
+	// never let anyone delete the root itself
+	if normalizedPath == ROOT {
+		return os.ErrPermission
+	}
+
+	// WebDAV removes things that don't exist without complaint
+	if _, err := STORAGE.Lstat(normalizedPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	return deletePath(ctx, normalizedPath)
+}
+
+func (fs rootFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, err := fs.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := fs.resolve(newName)
+	if err != nil {
+		return err
+	}
+
+	// moving the root would take everything else with it
+	if oldPath == ROOT || newPath == ROOT {
+		return os.ErrPermission
+	}
+
+	// WebDAV can't make links, but it mustn't move them anywhere we wouldn't
+	// have let it make them either
+	if err := checkMovedSymlink(oldPath, newPath); err != nil {
+		return os.ErrPermission
+	}
+
+	if err := saveVersion(newPath); err != nil {
+		return err
+	}
+
+	return STORAGE.Rename(oldPath, newPath)
+}
+
+func (fs rootFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	normalizedPath, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return STORAGE.Stat(normalizedPath)
+}
+
+// returns a handler serving the root over WebDAV under the given URL prefix
+func newDAVHandler(prefix string) http.Handler {
+	handler := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: rootFileSystem{},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("WebDAV %s %s failed: %s", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	// remember who deleted anything that ends up in the trash
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(withDeleter(r.Context(), "webdav "+remoteHost(r))))
+	})
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// how much of each file to hash before deciding whether to hash all of it.
+// files that differ usually do so early on.
+const dedupePrefixSize = 64 * 1024
+
+// a set of files with identical contents
+type DuplicateGroupJSON struct {
+	SHA256      string   `json:"sha256"`
+	Size        int64    `json:"size"`
+	Paths       []string `json:"paths"`
+	WastedBytes int64    `json:"wasted_bytes"` // what linking them would save
+}
+
+type DedupeReportJSON struct {
+	Groups      []DuplicateGroupJSON `json:"groups"`
+	WastedBytes int64                `json:"wasted_bytes"`
+	Linked      int64                `json:"linked"` // duplicates replaced with hard links
+}
+
+// a file on disk, along with every path it's reachable by. paths that are
+// already hard links to the same file don't waste anything.
+type dedupeFile struct {
+	info  os.FileInfo
+	paths []string // full paths, in the order we found them
+}
+
+// files with identical contents
+type dedupeGroup struct {
+	sum   string
+	files []*dedupeFile
+}
+
+// returns the SHA-256 of a file, or of only its first `limit` bytes if limit
+// isn't negative.
+func hashFile(filePath string, limit int64) (string, error) {
+	f, err := STORAGE.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// groups files by the hash of (some of) their contents, keeping only groups
+// with more than one file in them.
+func groupByHash(job *Job, files []*dedupeFile, limit int64) map[string][]*dedupeFile {
+	groups := map[string][]*dedupeFile{}
+	for _, file := range files {
+		sum, err := hashFile(file.paths[0], limit)
+		if err != nil {
+			relPath, _ := filepath.Rel(ROOT, file.paths[0])
+			job.skip(relPath, "could not be read")
+			continue
+		}
+
+		// only count what we actually read for full hashes, so the byte count
+		// ends up as the amount of data that really had to be compared.
+		if limit < 0 {
+			job.progress(1, file.info.Size())
+		}
+		groups[sum] = append(groups[sum], file)
+	}
+
+	for sum, group := range groups {
+		if len(group) < 2 {
+			delete(groups, sum)
+		}
+	}
+	return groups
+}
+
+// finds every set of identical files under a directory. files are compared
+// by size first, then by the hash of their first few bytes, and only files
+// that match on both get hashed in full.
+func findDuplicates(job *Job, dirPath string) ([]dedupeGroup, error) {
+	bySize := map[int64][]*dedupeFile{}
+	err := walkStorage(STORAGE, dirPath, func(fullPath string, file os.FileInfo, err error) error {
+		if err != nil {
+			relPath, _ := filepath.Rel(ROOT, fullPath)
+			job.skip(relPath, "could not be read")
+			if file != nil && file.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// skip the trash and anything still being written
+		if isReservedName(file.Name()) {
+			if file.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// empty files all match each other, but there's nothing to save
+		if !file.Mode().IsRegular() || file.Size() == 0 {
+			return nil
+		}
+
+		// paths that are already links to a file we've seen join that file
+		group := bySize[file.Size()]
+		for _, seen := range group {
+			if os.SameFile(seen.info, file) {
+				seen.paths = append(seen.paths, fullPath)
+				return nil
+			}
+		}
+		bySize[file.Size()] = append(group, &dedupeFile{file, []string{fullPath}})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	duplicates := []dedupeGroup{}
+	for size, files := range bySize {
+		if len(files) < 2 {
+			continue
+		}
+
+		// small files are hashed in full by the first pass anyway
+		candidates := [][]*dedupeFile{files}
+		if size > dedupePrefixSize {
+			candidates = nil
+			for _, group := range groupByHash(job, files, dedupePrefixSize) {
+				candidates = append(candidates, group)
+			}
+		}
+
+		for _, group := range candidates {
+			for sum, identical := range groupByHash(job, group, -1) {
+				duplicates = append(duplicates, dedupeGroup{sum, identical})
+			}
+		}
+	}
+
+	return duplicates, nil
+}
+
+// replaces a file with a hard link to another one. the link is made next to
+// the file first and moved over it, so the file is never missing.
+func replaceWithLink(originalPath string, duplicatePath string) error {
+	// only the local disk has hard links
+	localOriginal, err := localPath(originalPath)
+	if err != nil {
+		return err
+	}
+
+	tempPath := tempPathIn(filepath.Dir(duplicatePath), "dedupe")
+	localTemp, err := localPath(tempPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Link(localOriginal, localTemp); err != nil {
+		return err
+	}
+
+	if err := STORAGE.Rename(tempPath, duplicatePath); err != nil {
+		STORAGE.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// a local file opened for writing. if it's a copy of an existing file, the
+// copy replaces the file when it's closed.
+type rewrittenFile struct {
+	*os.File
+	replacePath string // empty if the file is being written in place
+}
+
+func (f *rewrittenFile) Close() error {
+	err := f.File.Close()
+	if f.replacePath == "" {
+		return err
+	}
+
+	if err == nil {
+		err = os.Rename(f.File.Name(), f.replacePath)
+	}
+	if err != nil {
+		os.Remove(f.File.Name())
+	}
+	return err
+}
+
+// opens a local file for writing like os.OpenFile, except that an existing
+// file is never changed in place. writes go to a copy of it instead, which
+// replaces it once closed. otherwise every name hard linked to the file, like
+// the ones we make when deduplicating, would change along with it.
+func openRewrittenFile(filePath string, flag int, perm os.FileMode) (*rewrittenFile, error) {
+	file, err := os.Stat(filePath)
+	if err != nil || flag&os.O_EXCL != 0 || !file.Mode().IsRegular() {
+		// there's nothing to share contents with, so write to it directly
+		f, err := os.OpenFile(filePath, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &rewrittenFile{File: f}, nil
+	}
+
+	// replace whatever a link leads to rather than the link itself
+	realPath, err := filepath.EvalSymlinks(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	tempPath := tempPathIn(filepath.Dir(realPath), "write")
+	f, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, file.Mode().Perm())
+	if err != nil {
+		return nil, err
+	}
+
+	// start from the old contents unless they're being thrown away anyway
+	if flag&os.O_TRUNC == 0 {
+		err = copyFileContents(f, realPath)
+		if err == nil && flag&os.O_APPEND == 0 {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tempPath)
+		return nil, err
+	}
+
+	return &rewrittenFile{File: f, replacePath: realPath}, nil
+}
+
+// copies the contents of a local file to a writer
+func copyFileContents(w io.Writer, filePath string) error {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// returns whether a path still leads to the file we hashed, unmodified
+func unchangedSince(fullPath string, file os.FileInfo) bool {
+	current, err := STORAGE.Lstat(fullPath)
+	return err == nil && os.SameFile(current, file) &&
+		current.Size() == file.Size() && current.ModTime().Equal(file.ModTime())
+}
+
+// hard links every copy in a group of identical files to the first one,
+// returning how many paths were replaced. copies that changed since we hashed
+// them are left alone.
+func linkDuplicates(job *Job, group []*dedupeFile) int64 {
+	original := group[0]
+	if !unchangedSince(original.paths[0], original.info) {
+		relPath, _ := filepath.Rel(ROOT, original.paths[0])
+		job.skip(relPath, "changed while looking for duplicates")
+		return 0
+	}
+
+	var linked int64
+	for _, duplicate := range group[1:] {
+		for _, duplicatePath := range duplicate.paths {
+			relPath, _ := filepath.Rel(ROOT, duplicatePath)
+			if !unchangedSince(duplicatePath, duplicate.info) {
+				job.skip(relPath, "changed while looking for duplicates")
+				continue
+			}
+
+			if err := replaceWithLink(original.paths[0], duplicatePath); err != nil {
+				// most likely the two are on different volumes
+				job.skip(relPath, "could not be linked")
+				continue
+			}
+			linked++
+		}
+	}
+	return linked
+}
+
+// looks for duplicate files as a background job, reporting each set of
+// identical files in the job's result. the `path` parameter gives the
+// directory to look in (defaulting to the root), and if `link` is `true`
+// duplicates are replaced with hard links to a single copy.
+//
+// NOTE: linked copies share the first copy's permissions and modification
+// time, since they become the same file. writes over WebDAV, SFTP and the like
+// replace a linked copy rather than changing it in place, but changing the
+// permissions or times of one (over SFTP, say) changes them all.
+func dedupeFiles(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	rawPath := r.Form.Get("path")
+	dirPath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	dir, err := STORAGE.Stat(dirPath)
+	if err != nil || !dir.IsDir() {
+		// don't report the raw error in case we leak server directory information
+		http.Error(w, "Could not find directory "+rawPath, 404)
+		return
+	}
+
+	link := r.Form.Get("link") == "true"
+
+	job := startJob("dedupe", func(job *Job) error {
+		duplicates, err := findDuplicates(job, dirPath)
+		if err != nil {
+			return fmt.Errorf("Could not search %s", rawPath)
+		}
+
+		report := DedupeReportJSON{Groups: []DuplicateGroupJSON{}}
+		for _, duplicate := range duplicates {
+			// keep the same copy no matter what order the walk found them in
+			group := duplicate.files
+			sort.Slice(group, func(i, j int) bool { return group[i].paths[0] < group[j].paths[0] })
+
+			size := group[0].info.Size()
+			result := DuplicateGroupJSON{
+				SHA256:      duplicate.sum,
+				Size:        size,
+				Paths:       []string{},
+				WastedBytes: size * int64(len(group)-1),
+			}
+			for _, file := range group {
+				for _, fullPath := range file.paths {
+					relPath, _ := filepath.Rel(ROOT, fullPath)
+					result.Paths = append(result.Paths, filepath.ToSlash(relPath))
+				}
+			}
+
+			if link {
+				report.Linked += linkDuplicates(job, group)
+			}
+
+			report.Groups = append(report.Groups, result)
+			report.WastedBytes += result.WastedBytes
+		}
+
+		// the biggest savings first
+		sort.Slice(report.Groups, func(i, j int) bool {
+			a, b := report.Groups[i], report.Groups[j]
+			if a.WastedBytes != b.WastedBytes {
+				return a.WastedBytes > b.WastedBytes
+			}
+			return a.Paths[0] < b.Paths[0]
+		})
+
+		job.Lock()
+		job.Result = report
+		job.Unlock()
+		return nil
+	})
+
+	writeJSONResponse(w, job.JSON())
+}
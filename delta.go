@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// limits on the block size used to split files up for delta syncing. without
+// a requested size we use roughly the square root of the file's size, like
+// rsync does, so big files don't end up with huge signatures.
+const (
+	minDeltaBlockSize = 4 * 1024
+	maxDeltaBlockSize = 1024 * 1024
+)
+
+// the operations a delta is made of. each starts with its byte, followed by
+// its arguments as unsigned varints. literals are followed by their data.
+const (
+	deltaOpCopy    = 'C' // copy a run of blocks from the old file: index, count
+	deltaOpLiteral = 'L' // write new data: length, data
+	deltaOpEnd     = 'E' // the delta is complete
+)
+
+// the checksums of every block of a file, which a client compares its own
+// copy against to work out what changed.
+type SignatureJSON struct {
+	Version   string               `json:"version"` // changes whenever the file does
+	Size      int64                `json:"size"`
+	BlockSize int                  `json:"block_size"`
+	Blocks    []BlockSignatureJSON `json:"blocks"`
+}
+
+type BlockSignatureJSON struct {
+	Weak   uint32 `json:"weak"`   // rolling checksum, cheap to compare
+	Strong string `json:"strong"` // truncated SHA-256, to confirm a match
+}
+
+type DeltaResultJSON struct {
+	Size         int64 `json:"size"`
+	CopiedBytes  int64 `json:"copied_bytes"`
+	LiteralBytes int64 `json:"literal_bytes"`
+}
+
+// the rsync rolling checksum: two 16-bit sums, one of the bytes and one of
+// the running totals, which can be updated a byte at a time as the window
+// slides along.
+type rollingChecksum struct {
+	a, b uint32
+	size uint32
+}
+
+func newRollingChecksum(block []byte) rollingChecksum {
+	var a, b uint32
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+
+	return rollingChecksum{a & 0xffff, b & 0xffff, uint32(len(block))}
+}
+
+// slides the window along one byte, dropping `out` and adding `in`
+func (r *rollingChecksum) roll(out byte, in byte) {
+	r.a = (r.a - uint32(out) + uint32(in)) & 0xffff
+	r.b = (r.b - r.size*uint32(out) + r.a) & 0xffff
+}
+
+func (r rollingChecksum) sum() uint32 {
+	return r.a | r.b<<16
+}
+
+// the hash we confirm weak checksum matches with, truncated since it only has
+// to tell apart blocks that already share a weak checksum.
+func strongChecksum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
+
+// returns the block size to use for a file of the given size
+func defaultDeltaBlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+
+	// round to a whole number of kilobytes, which is kinder to the disk
+	blockSize = (blockSize + 1023) / 1024 * 1024
+	if blockSize < minDeltaBlockSize {
+		return minDeltaBlockSize
+	} else if blockSize > maxDeltaBlockSize {
+		return maxDeltaBlockSize
+	}
+	return blockSize
+}
+
+// computes the signature of everything in the given reader
+func computeSignature(r io.Reader, blockSize int) ([]BlockSignatureJSON, int64, error) {
+	blocks := []BlockSignatureJSON{}
+	block := make([]byte, blockSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			blocks = append(blocks, BlockSignatureJSON{
+				newRollingChecksum(block[:n]).sum(),
+				strongChecksum(block[:n]),
+			})
+			size += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blocks, size, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// returns the version of a file a delta has to be based on. this is exactly
+// what we cache things by, so it changes whenever the file does.
+func deltaVersion(filePath string, file os.FileInfo) string {
+	return cacheKey(filePath, file, "delta")
+}
+
+// parses the block size requested by the client, if any
+func parseBlockSize(query url.Values, size int64) (int, error) {
+	raw := query.Get("block_size")
+	if raw == "" {
+		return defaultDeltaBlockSize(size), nil
+	}
+
+	blockSize, err := strconv.Atoi(raw)
+	if err != nil || blockSize < minDeltaBlockSize || blockSize > maxDeltaBlockSize {
+		return 0, fmt.Errorf("Block size must be between %d and %d", minDeltaBlockSize, maxDeltaBlockSize)
+	}
+	return blockSize, nil
+}
+
+// returns the block checksums of a file so a client can work out which parts
+// of it they need to send to bring it up to date. the block size can be given
+// with the `block_size` parameter.
+func getSignature(w http.ResponseWriter, r *http.Request) {
+	rawPath := mux.Vars(r)["path"]
+	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	file, err := STORAGE.Stat(normalizedPath)
+	if err != nil || !file.Mode().IsRegular() {
+		// don't report the raw error in case we leak server directory information
+		http.Error(w, "Could not find "+rawPath, 404)
+		return
+	}
+
+	blockSize, err := parseBlockSize(r.URL.Query(), file.Size())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// signatures of big files take a while to compute, so keep them around
+	version := deltaVersion(normalizedPath, file)
+	key := cacheKey(normalizedPath, file, "signature", strconv.Itoa(blockSize))
+	if data, ok := readCache(key); ok {
+		writeJSONResponse(w, json.RawMessage(data))
+		return
+	}
+
+	f, err := STORAGE.Open(normalizedPath)
+	if err != nil {
+		http.Error(w, "Could not read "+rawPath, 500)
+		return
+	}
+	defer f.Close()
+
+	blocks, size, err := computeSignature(bufio.NewReader(f), blockSize)
+	if err != nil {
+		http.Error(w, "Could not read "+rawPath, 500)
+		return
+	}
+
+	data, err := json.Marshal(SignatureJSON{version, size, blockSize, blocks})
+	if err != nil {
+		http.Error(w, "Failed to generate JSON response", 500)
+		return
+	}
+
+	// failing to cache isn't fatal, we'll just have to compute it again later
+	if err := writeCache(key, data); err != nil {
+		log.Printf("Failed to cache signature: %s", err)
+	}
+
+	writeJSONResponse(w, json.RawMessage(data))
+}
+
+// applies a delta read from the given reader to the old version of a file,
+// writing the new version to the given writer.
+func applyDelta(delta *bufio.Reader, old io.ReaderAt, oldSize int64, blockSize int, w io.Writer) (DeltaResultJSON, error) {
+	var result DeltaResultJSON
+	numBlocks := (oldSize + int64(blockSize) - 1) / int64(blockSize)
+
+	for {
+		op, err := delta.ReadByte()
+		if err != nil {
+			return result, fmt.Errorf("Delta ended unexpectedly")
+		}
+
+		switch op {
+		case deltaOpCopy:
+			index, err1 := binary.ReadUvarint(delta)
+			count, err2 := binary.ReadUvarint(delta)
+			if err1 != nil || err2 != nil || count == 0 || index >= uint64(numBlocks) || count > uint64(numBlocks)-index {
+				return result, fmt.Errorf("Invalid block range in delta")
+			}
+
+			offset := int64(index) * int64(blockSize)
+			length := int64(count) * int64(blockSize)
+			if offset+length > oldSize {
+				length = oldSize - offset
+			}
+
+			n, err := io.Copy(w, io.NewSectionReader(old, offset, length))
+			result.CopiedBytes += n
+			if err != nil {
+				return result, err
+			}
+
+		case deltaOpLiteral:
+			length, err := binary.ReadUvarint(delta)
+			if err != nil || length > math.MaxInt64 {
+				return result, fmt.Errorf("Invalid literal in delta")
+			}
+
+			n, err := io.CopyN(w, delta, int64(length))
+			result.LiteralBytes += n
+			if err == io.EOF {
+				return result, fmt.Errorf("Delta ended unexpectedly")
+			} else if err != nil {
+				return result, err
+			}
+
+		case deltaOpEnd:
+			result.Size = result.CopiedBytes + result.LiteralBytes
+			return result, nil
+
+		default:
+			return result, fmt.Errorf("Unknown operation in delta")
+		}
+	}
+}
+
+// updates a file from a delta against the version described by a signature,
+// replacing it atomically once the whole thing has arrived and checks out.
+// the `base` parameter is the version from the signature (or empty to create
+// a new file from nothing but literals), `block_size` the block size it used,
+// and `sha256` the hash the new file must have.
+func patchFile(w http.ResponseWriter, r *http.Request) {
+	rawPath := mux.Vars(r)["path"]
+	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	query := r.URL.Query()
+	expectedHash := query.Get("sha256")
+	if len(expectedHash) != sha256.Size*2 {
+		http.Error(w, "The new file's SHA-256 is required", 400)
+		return
+	}
+
+	// the delta only makes sense against the exact file the client saw
+	var old StorageFile
+	var oldSize int64
+	file, err := STORAGE.Stat(normalizedPath)
+	if base := query.Get("base"); base == "" {
+		if err == nil {
+			// HTTP 409 - Conflict
+			http.Error(w, rawPath+" already exists", 409)
+			return
+		}
+	} else {
+		if err != nil || !file.Mode().IsRegular() || deltaVersion(normalizedPath, file) != base {
+			http.Error(w, rawPath+" has changed", 409)
+			return
+		}
+
+		old, err = STORAGE.Open(normalizedPath)
+		if err != nil {
+			http.Error(w, "Could not read "+rawPath, 500)
+			return
+		}
+		defer old.Close()
+		oldSize = file.Size()
+	}
+
+	blockSize, err := parseBlockSize(query, oldSize)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	parent, err := STORAGE.Stat(filepath.Dir(normalizedPath))
+	if err != nil || !parent.IsDir() {
+		http.Error(w, "Could not find the directory for "+rawPath, 404)
+		return
+	}
+
+	// build the new version next to the old one so nobody ever sees it half
+	// done, and so we can move it into place in one go. if the old one is a
+	// link, that's next to wherever it leads so the link stays a link.
+	targetPath := replacedPath(normalizedPath)
+	tempPath := tempPathIn(filepath.Dir(targetPath), "delta")
+	f, err := STORAGE.Create(tempPath)
+	if err != nil {
+		http.Error(w, "Could not create "+rawPath, 500)
+		return
+	}
+
+	h := sha256.New()
+	out := bufio.NewWriter(io.MultiWriter(f, h))
+	result, err := applyDelta(bufio.NewReader(r.Body), old, oldSize, blockSize, out)
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != expectedHash {
+		err = fmt.Errorf("The patched file doesn't match its SHA-256")
+	}
+	if err != nil {
+		STORAGE.Remove(tempPath)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if old != nil {
+		if err := keepPermissions(tempPath, file); err != nil {
+			STORAGE.Remove(tempPath)
+			http.Error(w, "Could not replace "+rawPath, 500)
+			return
+		}
+	}
+
+	if err := saveVersion(normalizedPath); err != nil {
+		STORAGE.Remove(tempPath)
+		http.Error(w, "Could not keep the previous version of "+rawPath, 500)
+		return
+	}
+
+	if err := STORAGE.Rename(tempPath, targetPath); err != nil {
+		STORAGE.Remove(tempPath)
+		http.Error(w, "Could not replace "+rawPath, 500)
+		return
+	}
+
+	writeJSONResponse(w, result)
+}
+
+// writes the operations of a delta, merging runs of copied blocks together
+type deltaWriter struct {
+	w          *bufio.Writer
+	copyIndex  int // the first block of the run being copied, if any
+	copyCount  int
+	copyRuns   int // how many runs of copied blocks we've written
+	firstIndex int // the first block of the first run
+	copiedSize int64
+	literals   int64
+}
+
+func (d *deltaWriter) writeUvarints(op byte, values ...uint64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	if err := d.w.WriteByte(op); err != nil {
+		return err
+	}
+	for _, value := range values {
+		n := binary.PutUvarint(buf, value)
+		if _, err := d.w.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writes out the run of copied blocks we've been building up, if any
+func (d *deltaWriter) flushCopy() error {
+	if d.copyCount == 0 {
+		return nil
+	}
+
+	if d.copyRuns == 0 {
+		d.firstIndex = d.copyIndex
+	}
+	d.copyRuns++
+
+	err := d.writeUvarints(deltaOpCopy, uint64(d.copyIndex), uint64(d.copyCount))
+	d.copyCount = 0
+	return err
+}
+
+func (d *deltaWriter) copyBlock(index int, size int) error {
+	d.copiedSize += int64(size)
+	if d.copyCount > 0 && d.copyIndex+d.copyCount == index {
+		d.copyCount++
+		return nil
+	}
+
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.copyIndex = index
+	d.copyCount = 1
+	return nil
+}
+
+func (d *deltaWriter) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	if err := d.writeUvarints(deltaOpLiteral, uint64(len(data))); err != nil {
+		return err
+	}
+
+	d.literals += int64(len(data))
+	_, err := d.w.Write(data)
+	return err
+}
+
+func (d *deltaWriter) end() error {
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	if err := d.w.WriteByte(deltaOpEnd); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// the outcome of comparing a file against a signature
+type deltaStats struct {
+	CopiedBytes  int64
+	LiteralBytes int64
+	SHA256       string
+	Unchanged    bool // whether the delta just copies the whole old file
+}
+
+// compares the contents of a reader against a signature, writing a delta that
+// turns the file the signature describes into the reader's contents. this
+// never holds more than a couple of blocks in memory, however big the file.
+func writeDelta(r io.Reader, signature SignatureJSON, w io.Writer) (deltaStats, error) {
+	blockSize := signature.BlockSize
+
+	// find blocks by their weak checksum first, since that's all we can afford
+	// to compute at every offset.
+	blocksByWeak := map[uint32][]int{}
+	for i, block := range signature.Blocks {
+		blocksByWeak[block.Weak] = append(blocksByWeak[block.Weak], i)
+	}
+	lastBlockSize := int(signature.Size % int64(blockSize))
+	if lastBlockSize == 0 {
+		lastBlockSize = blockSize
+	}
+
+	// returns the block matching the given data, or -1 if none do
+	match := func(weak uint32, data []byte) int {
+		candidates, ok := blocksByWeak[weak]
+		if !ok {
+			return -1
+		}
+
+		strong := strongChecksum(data)
+		for _, i := range candidates {
+			size := blockSize
+			if i == len(signature.Blocks)-1 {
+				size = lastBlockSize
+			}
+			if size == len(data) && signature.Blocks[i].Strong == strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	h := sha256.New()
+	r = io.TeeReader(r, h)
+	d := &deltaWriter{w: bufio.NewWriter(w)}
+
+	// the data we're working through. everything before `literalStart` has
+	// been dealt with, and the window we're checksumming starts at `start`.
+	buf := make([]byte, 0, 4*blockSize)
+	literalStart, start := 0, 0
+	eof := false
+	var checksum rollingChecksum
+	haveChecksum := false
+
+	for {
+		// make sure there's a whole window's worth of data ahead of us if we can
+		if !eof && len(buf)-start < blockSize {
+			// flush any pending literal first so we can drop what's behind us
+			if literalStart < start {
+				if err := d.literal(buf[literalStart:start]); err != nil {
+					return deltaStats{}, err
+				}
+			}
+			buf = append(buf[:0], buf[start:]...)
+			literalStart, start = 0, 0
+
+			for len(buf) < cap(buf) {
+				n, err := r.Read(buf[len(buf):cap(buf)])
+				buf = buf[:len(buf)+n]
+				if err == io.EOF {
+					eof = true
+					break
+				} else if err != nil {
+					return deltaStats{}, err
+				}
+			}
+		}
+
+		remaining := len(buf) - start
+		if remaining == 0 {
+			break
+		}
+
+		// only the final block of the old file can be short, so a short window
+		// at the end is the only place one could match.
+		if remaining < blockSize {
+			if i := match(newRollingChecksum(buf[start:]).sum(), buf[start:]); i >= 0 && i == len(signature.Blocks)-1 {
+				if err := d.literal(buf[literalStart:start]); err != nil {
+					return deltaStats{}, err
+				}
+				if err := d.copyBlock(i, remaining); err != nil {
+					return deltaStats{}, err
+				}
+				literalStart, start = len(buf), len(buf)
+			} else {
+				start = len(buf)
+			}
+			continue
+		}
+
+		window := buf[start : start+blockSize]
+		if !haveChecksum {
+			checksum = newRollingChecksum(window)
+			haveChecksum = true
+		}
+
+		if i := match(checksum.sum(), window); i >= 0 {
+			if err := d.literal(buf[literalStart:start]); err != nil {
+				return deltaStats{}, err
+			}
+			if err := d.copyBlock(i, blockSize); err != nil {
+				return deltaStats{}, err
+			}
+
+			start += blockSize
+			literalStart = start
+			haveChecksum = false
+			continue
+		}
+
+		// no match, so slide along a byte. the byte we leave behind becomes part
+		// of the literal data.
+		if start+blockSize < len(buf) {
+			checksum.roll(buf[start], buf[start+blockSize])
+		} else {
+			haveChecksum = false
+		}
+		start++
+	}
+
+	if err := d.literal(buf[literalStart:start]); err != nil {
+		return deltaStats{}, err
+	}
+	if err := d.end(); err != nil {
+		return deltaStats{}, err
+	}
+
+	// a single run of every block in order is the old file as it was
+	unchanged := d.literals == 0 && d.copiedSize == signature.Size && d.copyRuns <= 1 && d.firstIndex == 0
+
+	return deltaStats{d.copiedSize, d.literals, hex.EncodeToString(h.Sum(nil)), unchanged}, nil
+}
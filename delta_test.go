@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+const testBlockSize = 16
+
+// returns the given number of bytes that won't repeat by accident
+func testDeltaData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// computes a delta from one version of a file to another and applies it,
+// failing unless the result is the new version.
+func roundTripDelta(t *testing.T, old []byte, new []byte) deltaStats {
+	t.Helper()
+
+	blocks, size, err := computeSignature(bytes.NewReader(old), testBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := SignatureJSON{"version", size, testBlockSize, blocks}
+
+	var delta bytes.Buffer
+	stats, err := writeDelta(bytes.NewReader(new), signature, &delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(new); stats.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected SHA-256 %s", stats.SHA256)
+	}
+
+	var patched bytes.Buffer
+	result, err := applyDelta(bufio.NewReader(&delta), bytes.NewReader(old), int64(len(old)), testBlockSize, &patched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patched.Bytes(), new) {
+		t.Fatalf("patched file doesn't match: %q, expected %q", patched.Bytes(), new)
+	}
+	if result.Size != int64(len(new)) || result.CopiedBytes != stats.CopiedBytes || result.LiteralBytes != stats.LiteralBytes {
+		t.Errorf("applying the delta gave %+v, writing it gave %+v", result, stats)
+	}
+
+	return stats
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	old := testDeltaData(10*testBlockSize, 1)
+	short := testDeltaData(10*testBlockSize+5, 2) // ends in a short block
+	insert := []byte("inserted")
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	tests := []struct {
+		name      string
+		old       []byte
+		new       []byte
+		literals  int64
+		unchanged bool
+	}{
+		{"unchanged", old, old, 0, true},
+		{"insert at start", old, join(insert, old), int64(len(insert)), false},
+		{"insert and delete in the middle", old, join(old[:3*testBlockSize], insert, old[5*testBlockSize:]), int64(len(insert)), false},
+		{"append", old, join(old, insert), int64(len(insert)), false},
+		{"truncate", old, old[:4*testBlockSize], 0, false},
+		{"reorder", old, join(old[5*testBlockSize:], old[:5*testBlockSize]), 0, false},
+		{"short last block unchanged", short, short, 0, true},
+		{"short last block after an insert", short, join(insert, short), int64(len(insert)), false},
+		{"short last block changed", short, join(short[:len(short)-1], []byte("!")), 5, false},
+		{"empty base", nil, old, int64(len(old)), false},
+		{"empty new", old, nil, 0, false},
+		{"both empty", nil, nil, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats := roundTripDelta(t, test.old, test.new)
+			if stats.LiteralBytes != test.literals {
+				t.Errorf("expected %d literal bytes, got %d", test.literals, stats.LiteralBytes)
+			}
+			if stats.CopiedBytes != int64(len(test.new))-test.literals {
+				t.Errorf("expected %d copied bytes, got %d", int64(len(test.new))-test.literals, stats.CopiedBytes)
+			}
+			if stats.Unchanged != test.unchanged {
+				t.Errorf("expected unchanged to be %v", test.unchanged)
+			}
+		})
+	}
+}
+
+func TestApplyDeltaRejectsMalformedDeltas(t *testing.T) {
+	old := testDeltaData(4*testBlockSize, 1)
+
+	// builds a delta out of operations and their varint arguments
+	op := func(op byte, values ...uint64) []byte {
+		buf := []byte{op}
+		for _, value := range values {
+			buf = binary.AppendUvarint(buf, value)
+		}
+		return buf
+	}
+
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{"copy past the end", op(deltaOpCopy, 3, 2)},
+		{"copy starting past the end", op(deltaOpCopy, 4, 1)},
+		{"copy of nothing", op(deltaOpCopy, 0, 0)},
+		{"copy with a huge count", op(deltaOpCopy, 1, 1<<63)},
+		{"truncated literal", append(op(deltaOpLiteral, 10), "short"...)},
+		{"unknown operation", op('X')},
+		{"no end", op(deltaOpCopy, 0, 1)},
+		{"empty", nil},
+	}
+
+	for _, test := range tests {
+		var patched bytes.Buffer
+		_, err := applyDelta(bufio.NewReader(bytes.NewReader(test.delta)), bytes.NewReader(old), int64(len(old)), testBlockSize, &patched)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
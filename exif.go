@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// the handful of EXIF fields we care about
+type EXIFData struct {
+	Make             string
+	Model            string
+	DateTimeOriginal string
+	HasGPS           bool
+	Latitude         float64
+	Longitude        float64
+}
+
+// EXIF tags we know how to read
+const (
+	exifTagMake             = 0x010f
+	exifTagModel            = 0x0110
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagGPSIFD           = 0x8825
+	exifTagDateTimeOriginal = 0x9003
+	exifTagGPSLatitudeRef   = 0x0001
+	exifTagGPSLatitude      = 0x0002
+	exifTagGPSLongitudeRef  = 0x0003
+	exifTagGPSLongitude     = 0x0004
+)
+
+// EXIF field types we know how to read
+const (
+	exifTypeASCII    = 2
+	exifTypeLong     = 4
+	exifTypeRational = 5
+)
+
+// a single raw entry from an image file directory
+type exifEntry struct {
+	Type  uint16
+	Count uint32
+	Value []byte // the raw bytes of the value, wherever they were stored
+}
+
+// reads the EXIF data from a JPEG stream. returns an error if the stream isn't
+// a JPEG or doesn't contain any EXIF data.
+func readJPEGEXIF(r io.Reader) (*EXIFData, error) {
+	br := bufio.NewReader(r)
+
+	// every JPEG starts with a start-of-image marker
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, fmt.Errorf("Not a JPEG")
+	}
+
+	// walk the segments until we find the APP1 segment holding the EXIF data.
+	// it always comes before the image data, so we can stop once we hit that.
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xff {
+			return nil, fmt.Errorf("No EXIF data")
+		}
+
+		// the length includes the two length bytes themselves
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return nil, fmt.Errorf("Invalid JPEG segment")
+		}
+
+		// start-of-scan means the image data is next, so there's no EXIF
+		if marker[1] == 0xda {
+			return nil, fmt.Errorf("No EXIF data")
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return nil, err
+		}
+
+		if marker[1] == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return parseEXIF(segment[6:])
+		}
+	}
+}
+
+// parses a raw TIFF-formatted EXIF block
+func parseEXIF(data []byte) (*EXIFData, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("Invalid EXIF data")
+	}
+
+	// the header tells us which byte order everything else uses
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("Invalid EXIF byte order")
+	}
+
+	ifd0, err := readEXIFDirectory(data, order, order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	exif := &EXIFData{
+		Make:             exifString(ifd0[exifTagMake]),
+		Model:            exifString(ifd0[exifTagModel]),
+		DateTimeOriginal: exifString(ifd0[exifTagDateTime]),
+	}
+
+	// the capture date lives in the EXIF sub-directory, and trumps the plain
+	// modification date from the main one.
+	if offset, ok := exifLong(ifd0[exifTagExifIFD], order); ok {
+		if exifIFD, err := readEXIFDirectory(data, order, offset); err == nil {
+			if captured := exifString(exifIFD[exifTagDateTimeOriginal]); captured != "" {
+				exif.DateTimeOriginal = captured
+			}
+		}
+	}
+
+	// GPS coordinates are stored as degrees/minutes/seconds in their own
+	// sub-directory, with separate entries for the hemisphere.
+	if offset, ok := exifLong(ifd0[exifTagGPSIFD], order); ok {
+		if gpsIFD, err := readEXIFDirectory(data, order, offset); err == nil {
+			lat, latOK := exifCoordinate(gpsIFD[exifTagGPSLatitude], order)
+			lon, lonOK := exifCoordinate(gpsIFD[exifTagGPSLongitude], order)
+			if latOK && lonOK {
+				if exifString(gpsIFD[exifTagGPSLatitudeRef]) == "S" {
+					lat = -lat
+				}
+				if exifString(gpsIFD[exifTagGPSLongitudeRef]) == "W" {
+					lon = -lon
+				}
+
+				exif.HasGPS = true
+				exif.Latitude = lat
+				exif.Longitude = lon
+			}
+		}
+	}
+
+	return exif, nil
+}
+
+// reads all the entries of the image file directory at the given offset
+func readEXIFDirectory(data []byte, order binary.ByteOrder, offset uint32) (map[uint16]exifEntry, error) {
+	if uint64(offset)+2 > uint64(len(data)) {
+		return nil, fmt.Errorf("Invalid EXIF directory offset")
+	}
+
+	count := int(order.Uint16(data[offset:]))
+	entries := make(map[uint16]exifEntry, count)
+
+	for i := 0; i < count; i++ {
+		start := uint64(offset) + 2 + uint64(i)*12
+		if start+12 > uint64(len(data)) {
+			return nil, fmt.Errorf("Truncated EXIF directory")
+		}
+		raw := data[start : start+12]
+
+		entry := exifEntry{
+			Type:  order.Uint16(raw[2:]),
+			Count: order.Uint32(raw[4:]),
+		}
+
+		// figure out how big the value is so we know where to find it
+		var size uint64
+		switch entry.Type {
+		case exifTypeASCII:
+			size = uint64(entry.Count)
+		case exifTypeLong:
+			size = 4 * uint64(entry.Count)
+		case exifTypeRational:
+			size = 8 * uint64(entry.Count)
+		default:
+			// we don't care about any other types
+			continue
+		}
+
+		// values of four bytes or fewer are stored in place of the offset
+		if size <= 4 {
+			entry.Value = raw[8 : 8+size]
+		} else {
+			valueOffset := uint64(order.Uint32(raw[8:]))
+			if valueOffset+size > uint64(len(data)) {
+				continue
+			}
+			entry.Value = data[valueOffset : valueOffset+size]
+		}
+
+		entries[order.Uint16(raw)] = entry
+	}
+
+	return entries, nil
+}
+
+// returns the value of an ASCII entry, or an empty string if it isn't one
+func exifString(entry exifEntry) string {
+	if entry.Type != exifTypeASCII {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimRight(string(entry.Value), "\x00"))
+}
+
+// returns the value of a single LONG entry
+func exifLong(entry exifEntry, order binary.ByteOrder) (uint32, bool) {
+	if entry.Type != exifTypeLong || len(entry.Value) < 4 {
+		return 0, false
+	}
+
+	return order.Uint32(entry.Value), true
+}
+
+// converts a degrees/minutes/seconds triple of RATIONAL values to decimal
+// degrees.
+func exifCoordinate(entry exifEntry, order binary.ByteOrder) (float64, bool) {
+	if entry.Type != exifTypeRational || len(entry.Value) < 24 {
+		return 0, false
+	}
+
+	coordinate := 0.0
+	divisor := 1.0
+	for i := 0; i < 3; i++ {
+		numerator := order.Uint32(entry.Value[i*8:])
+		denominator := order.Uint32(entry.Value[i*8+4:])
+		if denominator == 0 {
+			return 0, false
+		}
+
+		coordinate += float64(numerator) / float64(denominator) / divisor
+		divisor *= 60
+	}
+
+	return coordinate, true
+}
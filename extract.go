@@ -0,0 +1,378 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// limits on how much a single archive may extract to, so a small malicious
+// archive can't fill up the disk.
+var MAX_EXTRACT_BYTES int64 = 10 * 1024 * 1024 * 1024
+var MAX_EXTRACT_ENTRIES int64 = 100000
+
+// what to do when an extracted entry would replace something that exists
+const (
+	overwriteSkip    = "skip"      // leave the existing file alone
+	overwriteReplace = "overwrite" // replace the existing file
+	overwriteRename  = "rename"    // extract alongside it under a new name
+	overwriteFail    = "fail"      // stop extracting altogether
+)
+
+// a single entry read from an archive during extraction
+type extractEntry struct {
+	Name       string // exactly as it appears in the archive
+	Mode       os.FileMode
+	ModTime    time.Time
+	LinkTarget string
+}
+
+// calls the given function for every entry in an archive, in order. contents
+// are only given for regular files, and are only valid until it returns.
+func walkArchiveEntries(archivePath string, fn func(entry extractEntry, contents io.Reader) error) error {
+	kind := getArchiveKind(archivePath)
+	if kind == archiveKindZip {
+		z, closeZip, err := openZipArchive(archivePath)
+		if err != nil {
+			return err
+		}
+		defer closeZip()
+
+		for _, f := range z.File {
+			entry := extractEntry{Name: f.Name, Mode: f.Mode(), ModTime: f.Modified}
+			if strings.HasSuffix(f.Name, "/") {
+				entry.Mode |= os.ModeDir
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+
+			// ZIP archives store a symlink's destination as its contents
+			if entry.Mode&os.ModeSymlink == os.ModeSymlink {
+				dest, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+				rc.Close()
+				if err != nil {
+					return err
+				}
+
+				entry.LinkTarget = string(dest)
+				err = fn(entry, nil)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			err = fn(entry, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	stream, closeStream, err := openTarStream(archivePath, kind)
+	if err != nil {
+		return err
+	}
+	defer closeStream()
+
+	tr := tar.NewReader(stream)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		entry := extractEntry{
+			Name:       header.Name,
+			Mode:       header.FileInfo().Mode(),
+			ModTime:    header.ModTime,
+			LinkTarget: header.Linkname,
+		}
+
+		if err := fn(entry, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// returns a name for the given path that doesn't exist yet, adding a number to
+// it (before the extension) if necessary.
+func uniquePath(fullPath string) string {
+	ext := path.Ext(fullPath)
+	base := strings.TrimSuffix(fullPath, ext)
+
+	unique := fullPath
+	for i := 2; ; i++ {
+		if _, err := STORAGE.Lstat(unique); os.IsNotExist(err) {
+			return unique
+		}
+		unique = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+// extracts a single archive entry to the destination directory, applying the
+// given overwrite policy. returns an error only if extraction should stop.
+func extractEntryTo(job *Job, destPath string, policy string, entry extractEntry, contents io.Reader) error {
+	job.Lock()
+	written := job.Bytes
+	job.Unlock()
+
+	// reject any entry that tries to escape the destination, using the same
+	// rules we use for request paths.
+	name := strings.Replace(entry.Name, "\\", "/", -1)
+	if strings.HasPrefix(name, "/") {
+		job.skip(entry.Name, "absolute paths are not allowed")
+		return nil
+	}
+	target, err := normalizePathUnderRoot(destPath, name)
+	if err != nil {
+		job.skip(entry.Name, "path leaves the destination")
+		return nil
+	}
+	if target == destPath {
+		return nil
+	}
+
+	// never create anything through a symlink that leads out of the root. we
+	// have to check before creating any missing parent directories too, since
+	// doing so would follow any links along the way.
+	parent := filepath.Dir(target)
+	ancestor := parent
+	for {
+		if _, err := STORAGE.Lstat(ancestor); err == nil {
+			break
+		}
+		ancestor = filepath.Dir(ancestor)
+	}
+	if !resolvesUnderRoot(ancestor) {
+		job.skip(entry.Name, "path leaves the destination")
+		return nil
+	}
+	if err := STORAGE.MkdirAll(parent); err != nil {
+		return fmt.Errorf("Could not create the directory for %s", entry.Name)
+	}
+	if !resolvesUnderRoot(parent) {
+		job.skip(entry.Name, "path leaves the destination")
+		return nil
+	}
+
+	existing, err := STORAGE.Lstat(target)
+	exists := err == nil
+
+	// directories merge with any that are already there
+	if entry.Mode.IsDir() {
+		if exists && !existing.IsDir() {
+			job.skip(entry.Name, "conflicts with an existing file")
+			return nil
+		}
+
+		if err := STORAGE.MkdirAll(target); err != nil {
+			return fmt.Errorf("Could not create %s", entry.Name)
+		}
+		job.progress(1, 0)
+		return nil
+	}
+
+	isLink := entry.Mode&os.ModeSymlink == os.ModeSymlink
+	if !isLink && !entry.Mode.IsRegular() {
+		job.skip(entry.Name, "unsupported entry type")
+		return nil
+	}
+
+	if isLink {
+		if SYMLINK_POLICY == symlinksNever {
+			job.skip(entry.Name, "symlinks are disabled")
+			return nil
+		}
+		if err := checkNewSymlink(target, entry.LinkTarget); err != nil {
+			job.skip(entry.Name, "link points outside the root")
+			return nil
+		}
+	}
+
+	if exists {
+		switch policy {
+		case overwriteSkip:
+			job.skip(entry.Name, "already exists")
+			return nil
+		case overwriteFail:
+			return fmt.Errorf("%s already exists", entry.Name)
+		case overwriteRename:
+			target = uniquePath(target)
+		case overwriteReplace:
+			if existing.IsDir() {
+				job.skip(entry.Name, "conflicts with an existing directory")
+				return nil
+			}
+		}
+	}
+
+	if isLink {
+		if exists && policy == overwriteReplace {
+			if err := saveVersion(target); err != nil {
+				return fmt.Errorf("Could not keep the previous version of %s", entry.Name)
+			}
+			if err := STORAGE.Remove(target); err != nil {
+				return fmt.Errorf("Could not replace %s", entry.Name)
+			}
+		}
+
+		// only the local disk can hold links we make
+		localTarget, err := localPath(target)
+		if err == nil {
+			err = os.Symlink(entry.LinkTarget, localTarget)
+		}
+		if err != nil {
+			job.skip(entry.Name, "could not create link")
+			return nil
+		}
+		job.progress(1, 0)
+		return nil
+	}
+
+	// write to a temporary file first so nobody sees a partial file, and so a
+	// failure never clobbers whatever was there before.
+	tempPath := tempPathIn(parent, "extract")
+	f, err := STORAGE.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("Could not create %s", entry.Name)
+	}
+
+	// read one byte past what we have left so we can tell if we went over
+	remaining := MAX_EXTRACT_BYTES - written
+	n, err := io.Copy(f, io.LimitReader(contents, remaining+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		err = fmt.Errorf("Could not write %s", entry.Name)
+	} else if n > remaining {
+		err = fmt.Errorf("Archive expands to more than %d bytes", MAX_EXTRACT_BYTES)
+	} else if exists && policy == overwriteReplace && saveVersion(target) != nil {
+		err = fmt.Errorf("Could not keep the previous version of %s", entry.Name)
+	} else {
+		// permissions can only be kept on the local disk
+		// NOTE: Perm() drops any setuid/setgid bits the archive might have had
+		if localTemp, localErr := localPath(tempPath); localErr == nil {
+			err = os.Chmod(localTemp, entry.Mode.Perm())
+		}
+		if err == nil {
+			err = STORAGE.Rename(tempPath, target)
+		}
+		if err != nil {
+			err = fmt.Errorf("Could not write %s", entry.Name)
+		}
+	}
+	if err != nil {
+		STORAGE.Remove(tempPath)
+		return err
+	}
+
+	if localTarget, err := localPath(target); err == nil {
+		os.Chtimes(localTarget, entry.ModTime, entry.ModTime)
+	}
+	job.progress(1, n)
+	return nil
+}
+
+// extracts an archive into a directory as a background job. the `path`
+// parameter gives the archive, `destination` the directory to extract into
+// (defaulting to the archive's own directory), and `overwrite` what to do with
+// files that already exist: `skip` (the default), `overwrite`, `rename` or
+// `fail`.
+func extractArchive(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	rawPath := r.Form.Get("path")
+	archivePath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	file, err := STORAGE.Stat(archivePath)
+	if err != nil || !file.Mode().IsRegular() {
+		// don't report the raw error in case we leak server directory information
+		http.Error(w, "Could not find "+rawPath, 404)
+		return
+	}
+
+	if getArchiveKind(archivePath) == archiveKindNone {
+		// HTTP 415 - Unsupported Media Type
+		http.Error(w, "Unsupported archive type: "+file.Name(), 415)
+		return
+	}
+
+	destPath := filepath.Dir(archivePath)
+	if rawDest := r.Form.Get("destination"); rawDest != "" {
+		destPath, err = normalizePathUnderRoot(ROOT, rawDest)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	if dest, err := STORAGE.Stat(destPath); err == nil && !dest.IsDir() {
+		http.Error(w, "Destination is not a directory", 400)
+		return
+	}
+
+	policy := r.Form.Get("overwrite")
+	switch policy {
+	case "":
+		policy = overwriteSkip
+	case overwriteSkip, overwriteReplace, overwriteRename, overwriteFail:
+	default:
+		http.Error(w, "Unsupported overwrite policy: "+policy, 400)
+		return
+	}
+
+	job := startJob("extract", func(job *Job) error {
+		if err := STORAGE.MkdirAll(destPath); err != nil {
+			return fmt.Errorf("Could not create destination")
+		}
+
+		// errors from extracting entries are safe to show to the client, but
+		// errors from reading the archive might leak server paths.
+		var stopErr error
+		var entries int64
+		err := walkArchiveEntries(archivePath, func(entry extractEntry, contents io.Reader) error {
+			// count skipped entries too, otherwise an archive full of bad ones
+			// could keep us busy forever.
+			entries++
+			if entries > MAX_EXTRACT_ENTRIES {
+				stopErr = fmt.Errorf("Archive has more than %d entries", MAX_EXTRACT_ENTRIES)
+			} else {
+				stopErr = extractEntryTo(job, destPath, policy, entry, contents)
+			}
+			return stopErr
+		})
+		if stopErr != nil {
+			return stopErr
+		} else if err != nil {
+			return fmt.Errorf("Could not read archive")
+		}
+
+		return nil
+	})
+
+	writeJSONResponse(w, job.JSON())
+}
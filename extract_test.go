@@ -0,0 +1,267 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// extracts a regular file with the given contents into a directory, returning
+// the job it was extracted as part of.
+func extractTestFile(destPath string, policy string, name string, data string) (*Job, error) {
+	job := &Job{Skipped: []string{}}
+	entry := extractEntry{Name: name, Mode: 0644, ModTime: time.Now()}
+	return job, extractEntryTo(job, destPath, policy, entry, strings.NewReader(data))
+}
+
+// waits for a job to finish, returning how it went
+func waitForTestJob(t *testing.T, id string) JobJSON {
+	t.Helper()
+
+	var job JobJSON
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		w := serveTestRequest(httptest.NewRequest("GET", "/jobs/"+id, nil))
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+			t.Fatalf("%d %s: %s", w.Code, w.Body.String(), err)
+		}
+		if job.Status != jobRunning {
+			return job
+		}
+	}
+
+	t.Fatalf("job %s never finished", id)
+	return job
+}
+
+func TestExtractEntryStaysInTheDestination(t *testing.T) {
+	storage := useMemoryStorage(t)
+	if err := storage.MkdirAll("/bucket/dest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.MkdirAll("/outside"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Symlink("/outside", "/bucket/dest/escape"); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{
+		"../evil.txt",
+		"../../evil.txt",
+		"docs/../../evil.txt",
+		"/evil.txt",
+		"..\\evil.txt",
+		"docs\\..\\..\\evil.txt",
+		"escape/evil.txt",
+		"escape/deeper/evil.txt",
+		"evil.txt\x00",
+		".bucket-trash/evil.txt",
+	}
+
+	for _, name := range names {
+		job, err := extractTestFile("/bucket/dest", overwriteReplace, name, "evil")
+		if err != nil {
+			t.Errorf("%q: expected the entry to be skipped, got %s", name, err)
+		} else if len(job.Skipped) != 1 {
+			t.Errorf("%q: expected the entry to be skipped", name)
+		}
+	}
+
+	for _, name := range []string{"/bucket/evil.txt", "/evil.txt", "/outside/evil.txt", "/outside/deeper", "/bucket/dest/.bucket-trash"} {
+		if _, err := storage.Lstat(name); err == nil {
+			t.Errorf("%s was created outside the destination", name)
+		}
+	}
+
+	// names that only look suspicious are fine
+	for _, name := range []string{"notes..txt", "docs/./notes.txt", "docs/sub/../notes2.txt"} {
+		if job, err := extractTestFile("/bucket/dest", overwriteReplace, name, "fine"); err != nil || len(job.Skipped) != 0 {
+			t.Errorf("%q: expected the entry to be extracted: %v %v", name, err, job.Skipped)
+		}
+	}
+	for _, name := range []string{"/bucket/dest/notes..txt", "/bucket/dest/docs/notes.txt", "/bucket/dest/docs/notes2.txt"} {
+		expectTestFile(t, storage, name, "fine")
+	}
+}
+
+func TestExtractEntryOverwritePolicies(t *testing.T) {
+	tests := []struct {
+		policy   string
+		fails    bool
+		skipped  bool
+		existing string // what the existing file ends up containing
+		renamed  bool   // whether the new file is extracted under another name
+	}{
+		{overwriteSkip, false, true, "old", false},
+		{overwriteReplace, false, false, "new", false},
+		{overwriteRename, false, false, "old", true},
+		{overwriteFail, true, false, "old", false},
+	}
+
+	for _, test := range tests {
+		storage := useMemoryStorage(t)
+		writeTestFile(t, storage, "/bucket/dest/notes.txt", []byte("old"))
+
+		job, err := extractTestFile("/bucket/dest", test.policy, "notes.txt", "new")
+		if (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error %v", test.policy, err)
+		}
+		if (len(job.Skipped) != 0) != test.skipped {
+			t.Errorf("%s: unexpected skipped entries %v", test.policy, job.Skipped)
+		}
+
+		if data, err := readStorageFile(storage, "/bucket/dest/notes.txt"); err != nil || string(data) != test.existing {
+			t.Errorf("%s: expected the existing file to contain %q, got %q %v", test.policy, test.existing, data, err)
+		}
+		data, err := readStorageFile(storage, "/bucket/dest/notes (2).txt")
+		if test.renamed && (err != nil || string(data) != "new") {
+			t.Errorf("%s: expected the new file alongside the old one, got %q %v", test.policy, data, err)
+		} else if !test.renamed && err == nil {
+			t.Errorf("%s: didn't expect the new file to be renamed", test.policy)
+		}
+	}
+
+	// directories merge into existing ones whatever the policy, but never
+	// replace a file
+	storage := useMemoryStorage(t)
+	writeTestFile(t, storage, "/bucket/dest/docs/a.txt", []byte("a"))
+	writeTestFile(t, storage, "/bucket/dest/file", []byte("file"))
+	for _, name := range []string{"docs/", "file/"} {
+		job := &Job{Skipped: []string{}}
+		entry := extractEntry{Name: name, Mode: os.ModeDir | 0755}
+		if err := extractEntryTo(job, "/bucket/dest", overwriteReplace, entry, nil); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	expectTestFile(t, storage, "/bucket/dest/docs/a.txt", "a")
+	expectTestFile(t, storage, "/bucket/dest/file", "file")
+}
+
+func TestExtractEntrySymlinks(t *testing.T) {
+	useMemoryStorage(t)
+
+	// only the local disk can hold the links we make
+	ROOT = t.TempDir()
+	STORAGE = localStorage{}
+	destPath := filepath.Join(ROOT, "dest")
+	if err := os.MkdirAll(destPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy  string
+		name    string
+		target  string
+		allowed bool
+	}{
+		{symlinksRoot, "inside", "notes.txt", true},
+		{symlinksRoot, "docs/up", "../notes.txt", true},
+		{symlinksRoot, "up-to-root", "..", true},
+		{symlinksRoot, "relative-escape", "../../etc/passwd", false},
+		{symlinksRoot, "absolute-escape", "/etc/passwd", false},
+		{symlinksNever, "never", "notes.txt", false},
+
+		// links are followed anywhere, but new ones still only lead inside
+		{symlinksAny, "any-inside", "notes.txt", true},
+		{symlinksAny, "any-escape", "../../etc/passwd", false},
+		{symlinksAny, "any-absolute", filepath.Join(ROOT, "notes.txt"), false},
+	}
+
+	for _, test := range tests {
+		SYMLINK_POLICY = test.policy
+
+		job := &Job{Skipped: []string{}}
+		entry := extractEntry{Name: test.name, Mode: os.ModeSymlink | 0777, LinkTarget: test.target}
+		if err := extractEntryTo(job, destPath, overwriteSkip, entry, nil); err != nil {
+			t.Errorf("%s %s: %s", test.policy, test.name, err)
+		}
+
+		dest, err := os.Readlink(filepath.Join(destPath, test.name))
+		if test.allowed && (err != nil || dest != test.target) {
+			t.Errorf("%s %s: expected a link to %s, got %q %v (skipped %v)", test.policy, test.name, test.target, dest, err, job.Skipped)
+		} else if !test.allowed && (err == nil || len(job.Skipped) != 1) {
+			t.Errorf("%s %s: expected the link to be skipped", test.policy, test.name)
+		}
+	}
+
+	// nothing can be extracted through a link that leads out of the root, even
+	// once links are followed wherever they lead
+	SYMLINK_POLICY = symlinksRoot
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(destPath, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if job, err := extractTestFile(destPath, overwriteReplace, "out/evil.txt", "evil"); err != nil || len(job.Skipped) != 1 {
+		t.Errorf("expected extracting through a link out of the root to be skipped: %v %v", err, job.Skipped)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "evil.txt")); err == nil {
+		t.Errorf("extracted through a link out of the root")
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	storage := useMemoryStorage(t)
+
+	oldMaxBytes, oldMaxEntries := MAX_EXTRACT_BYTES, MAX_EXTRACT_ENTRIES
+	t.Cleanup(func() { MAX_EXTRACT_BYTES, MAX_EXTRACT_ENTRIES = oldMaxBytes, oldMaxEntries })
+
+	// the byte limit covers everything the job extracts, not just one entry
+	MAX_EXTRACT_BYTES = 10
+	job := &Job{Skipped: []string{}}
+	for i, data := range []string{"123456", "78901"} {
+		entry := extractEntry{Name: []string{"a.txt", "b.txt"}[i], Mode: 0644}
+		err := extractEntryTo(job, "/bucket/dest", overwriteSkip, entry, strings.NewReader(data))
+		if i == 0 && err != nil {
+			t.Fatalf("expected the first entry to fit: %s", err)
+		} else if i == 1 && err == nil {
+			t.Errorf("expected the second entry to go over the limit")
+		}
+	}
+	expectTestFile(t, storage, "/bucket/dest/a.txt", "123456")
+	if files, _ := storage.ReadDir("/bucket/dest"); len(files) != 1 {
+		t.Errorf("expected nothing but the first entry to be left behind, got %d files", len(files))
+	}
+
+	// the entry limit counts every entry, extracted or not
+	MAX_EXTRACT_BYTES = oldMaxBytes
+	MAX_EXTRACT_ENTRIES = 2
+
+	var zipData bytes.Buffer
+	z := zip.NewWriter(&zipData)
+	for _, name := range []string{"../skipped.txt", "one.txt", "two.txt"} {
+		f, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(name))
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, storage, "/bucket/files.zip", zipData.Bytes())
+
+	form := url.Values{"path": {"files.zip"}, "destination": {"out"}}
+	r := httptest.NewRequest("POST", "/extract", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := serveTestRequest(r)
+	var started JobJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil {
+		t.Fatalf("%d %s: %s", w.Code, w.Body.String(), err)
+	}
+
+	finished := waitForTestJob(t, started.ID)
+	if finished.Status != jobFailed || !strings.Contains(finished.Error, "more than 2 entries") {
+		t.Errorf("expected the job to fail on its third entry, got %+v", finished)
+	}
+	expectTestFile(t, storage, "/bucket/out/one.txt", "one.txt")
+	if _, err := storage.Lstat("/bucket/out/two.txt"); err == nil {
+		t.Errorf("expected nothing past the limit to be extracted")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// the formats we can convert images to, mapped to their MIME types
+var imageFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+}
+
+// camera RAW formats, which most systems don't know the MIME types of. we
+// register them ourselves so they're recognized as images everywhere.
+var rawImageTypes = map[string]string{
+	".arw": "image/x-sony-arw",
+	".cr2": "image/x-canon-cr2",
+	".crw": "image/x-canon-crw",
+	".dng": "image/x-adobe-dng",
+	".nef": "image/x-nikon-nef",
+	".orf": "image/x-olympus-orf",
+	".pef": "image/x-pentax-pef",
+	".raf": "image/x-fuji-raf",
+	".rw2": "image/x-panasonic-rw2",
+}
+
+func init() {
+	for ext, mimeType := range rawImageTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, mimeType)
+		}
+	}
+}
+
+const (
+	imageDefaultFormat  = "jpeg"
+	imageDefaultSize    = 1600 // default maximum width and height in pixels
+	imageMaxSize        = 8192 // largest width or height we'll generate in pixels
+	imageDefaultQuality = 85   // between 1 and 100, where 100 is best
+)
+
+// parses an integer query parameter, returning the fallback if it's missing
+// and an error if it's present but not between min and max.
+func parseIntParam(query url.Values, name string, fallback, min, max int) (int, error) {
+	raw := query.Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("%s must be between %d and %d", name, min, max)
+	}
+
+	return value, nil
+}
+
+// returns a resized and/or converted copy of an image. the `width` and
+// `height` query parameters give the maximum dimensions of the result (images
+// are only ever shrunk, never enlarged), `format` the format to convert to
+// (`jpeg`, `png` or `webp`), and `quality` the quality to encode it with,
+// between 1 and 100.
+func getImage(w http.ResponseWriter, r *http.Request) {
+	rawPath := mux.Vars(r)["path"]
+	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// ensure the file exists
+	file, err := STORAGE.Stat(normalizedPath)
+	if err != nil || file.IsDir() {
+		// don't report the raw error in case we leak server directory information
+		http.Error(w, "Could not find "+rawPath, 404)
+		return
+	}
+
+	mimeType := getMIMEType(normalizedPath)
+	if strings.Index(mimeType, "image") != 0 || mimeType == "image/svg+xml" {
+		// HTTP 415 - Unsupported Media Type
+		http.Error(w, "Unsupported file type: "+mimeType, 415)
+		return
+	}
+
+	// the file has to be on the local disk for GraphicsMagick to read it
+	filePath, err := localPath(normalizedPath)
+	if err != nil {
+		// HTTP 501 - Not Implemented
+		http.Error(w, err.Error(), 501)
+		return
+	}
+
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format == "" {
+		format = imageDefaultFormat
+	}
+	outputMIMEType, ok := imageFormats[format]
+	if !ok {
+		http.Error(w, "Unsupported format: "+format, 400)
+		return
+	}
+
+	width, err := parseIntParam(query, "width", imageDefaultSize, 1, imageMaxSize)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	height, err := parseIntParam(query, "height", imageDefaultSize, 1, imageMaxSize)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	quality, err := parseIntParam(query, "quality", imageDefaultQuality, 1, 100)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// tell the browser to cache this response for a good while to lower load
+	w.Header().Add("Cache-Control", "max-age=3600")
+
+	// serve a previously-generated image if we have one for this version of the
+	// file, since big images take a while to process.
+	key := cacheKey(normalizedPath, file, "image", format,
+		strconv.Itoa(width), strconv.Itoa(height), strconv.Itoa(quality))
+	if image, ok := readCache(key); ok {
+		w.Header().Add("Content-Type", outputMIMEType)
+		w.Write(image)
+		return
+	}
+
+	// the > tells GraphicsMagick to only ever shrink the image to fit within
+	// the dimensions, preserving the aspect ratio.
+	gmSize := fmt.Sprintf("%dx%d", width, height)
+
+	image, err := runProcess(exec.Command(
+		"gm", "convert",
+
+		// hint to the decoder how large an image we want, which lets it skip a
+		// lot of work for formats like JPEG. this must come _before_ the file!
+		"-size", gmSize,
+
+		// the file we're processing. only the first frame/page is used, so
+		// multi-page TIFFs and animated GIFs give us a single image.
+		filePath+"[0]",
+
+		// rotate the image upright according to its EXIF orientation, since we're
+		// about to strip that information.
+		"-auto-orient",
+
+		// shrink the image to fit within our bounds
+		"-resize", gmSize+">",
+
+		// strips EXIF/etc. (apparently basically all metadata) from the image
+		"+profile", "*",
+
+		// quality is between 1 and 100 where 100 is best
+		"-quality", strconv.Itoa(quality),
+
+		// output the requested format to stdout
+		format+":-",
+	))
+	if err != nil {
+		http.Error(w, "Error generating image", 500)
+		return
+	}
+
+	// failing to cache isn't fatal, we'll just have to generate it again later
+	if err := writeCache(key, image); err != nil {
+		log.Printf("Failed to cache image: %s", err)
+	}
+
+	w.Header().Add("Content-Type", outputMIMEType)
+	w.Write(image)
+}
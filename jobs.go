@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// how long finished jobs stick around so clients can check on their results
+const jobRetention = 24 * time.Hour
+
+// the states a job can be in
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// a long-running task that happens in the background, outside of any request.
+// all fields are protected by the job's lock, since the job updates them while
+// requests read them.
+type Job struct {
+	sync.Mutex
+
+	ID         string
+	Kind       string
+	Status     string
+	Error      string
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	// how far along the job is. what these count depends on the kind of job.
+	Processed int64
+	Bytes     int64
+
+	// items the job passed over, and why
+	Skipped []string
+
+	// anything else the job wants to report once it's done
+	Result interface{}
+}
+
+type JobJSON struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"`
+	Status     string      `json:"status"`
+	Error      string      `json:"error,omitempty"`
+	StartedAt  string      `json:"started_at"`
+	FinishedAt string      `json:"finished_at,omitempty"`
+	Processed  int64       `json:"processed"`
+	Bytes      int64       `json:"bytes"`
+	Skipped    []string    `json:"skipped"`
+	Result     interface{} `json:"result,omitempty"`
+}
+
+// every job we know about, keyed by ID
+var jobs = struct {
+	sync.Mutex
+	m map[string]*Job
+}{m: map[string]*Job{}}
+
+// starts running the given function in the background as a new job of the
+// given kind, returning the job. if the function returns an error, the job is
+// marked as failed with that error.
+func startJob(kind string, run func(job *Job) error) *Job {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	job := &Job{
+		ID:        hex.EncodeToString(id),
+		Kind:      kind,
+		Status:    jobRunning,
+		StartedAt: time.Now(),
+		Skipped:   []string{},
+	}
+
+	jobs.Lock()
+	// forget about jobs that finished a long time ago while we're here
+	for id, old := range jobs.m {
+		old.Lock()
+		expired := old.Status != jobRunning && time.Since(old.FinishedAt) > jobRetention
+		old.Unlock()
+
+		if expired {
+			delete(jobs.m, id)
+		}
+	}
+	jobs.m[job.ID] = job
+	jobs.Unlock()
+
+	go func() {
+		err := run(job)
+
+		job.Lock()
+		defer job.Unlock()
+
+		job.FinishedAt = time.Now()
+		if err != nil {
+			job.Status = jobFailed
+			job.Error = err.Error()
+		} else {
+			job.Status = jobDone
+		}
+	}()
+
+	return job
+}
+
+// records that the job passed over something, and why
+func (job *Job) skip(item string, reason string) {
+	job.Lock()
+	defer job.Unlock()
+
+	job.Skipped = append(job.Skipped, item+": "+reason)
+}
+
+// records progress made by the job
+func (job *Job) progress(processed int64, bytes int64) {
+	job.Lock()
+	defer job.Unlock()
+
+	job.Processed += processed
+	job.Bytes += bytes
+}
+
+// returns the JSON description of a job
+func (job *Job) JSON() JobJSON {
+	job.Lock()
+	defer job.Unlock()
+
+	finishedAt := ""
+	if !job.FinishedAt.IsZero() {
+		finishedAt = job.FinishedAt.UTC().Format("2006-01-02T15:04:05Z") // ISO 8601
+	}
+
+	return JobJSON{
+		job.ID,
+		job.Kind,
+		job.Status,
+		job.Error,
+		job.StartedAt.UTC().Format("2006-01-02T15:04:05Z"), // ISO 8601
+		finishedAt,
+		job.Processed,
+		job.Bytes,
+		append([]string{}, job.Skipped...),
+		job.Result,
+	}
+}
+
+// returns the status of a single job
+func getJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	jobs.Lock()
+	job, ok := jobs.m[id]
+	jobs.Unlock()
+
+	if !ok {
+		http.Error(w, "Could not find job "+id, 404)
+		return
+	}
+
+	writeJSONResponse(w, job.JSON())
+}
+
+// returns the status of every job, most recent first
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	jobs.Lock()
+	all := []JobJSON{}
+	for _, job := range jobs.m {
+		all = append(all, job.JSON())
+	}
+	jobs.Unlock()
+
+	// ISO 8601 timestamps sort chronologically as strings
+	sort.Slice(all, func(i, j int) bool { return all[i].StartedAt > all[j].StartedAt })
+
+	writeJSONResponse(w, all)
+}
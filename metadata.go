@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// media-specific information about a file. only the fields that apply to the
+// file (and that we could actually find) are included.
+type MetadataJSON struct {
+	Width      int      `json:"width,omitempty"`
+	Height     int      `json:"height,omitempty"`
+	Duration   float64  `json:"duration,omitempty"`
+	CapturedAt string   `json:"captured_at,omitempty"`
+	Camera     string   `json:"camera,omitempty"`
+	Latitude   *float64 `json:"latitude,omitempty"`
+	Longitude  *float64 `json:"longitude,omitempty"`
+	VideoCodec string   `json:"video_codec,omitempty"`
+	AudioCodec string   `json:"audio_codec,omitempty"`
+	Artist     string   `json:"artist,omitempty"`
+	Album      string   `json:"album,omitempty"`
+	Title      string   `json:"title,omitempty"`
+}
+
+// the parts of ffprobe's JSON output we care about
+type ffprobeOutput struct {
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string            `json:"codec_type"`
+		CodecName string            `json:"codec_name"`
+		Width     int               `json:"width"`
+		Height    int               `json:"height"`
+		Tags      map[string]string `json:"tags"`
+	} `json:"streams"`
+}
+
+// returns the value of a tag regardless of how its name is capitalized, since
+// every container seems to have its own opinion on the matter.
+func getTag(tags map[string]string, name string) string {
+	for key, value := range tags {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// fills in image dimensions and EXIF data using Go's own decoders, returning
+// false if the image isn't in a format we can read ourselves.
+func readImageMetadata(filePath string, metadata *MetadataJSON) bool {
+	f, err := STORAGE.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return false
+	}
+
+	metadata.Width = config.Width
+	metadata.Height = config.Height
+
+	// only JPEGs carry EXIF data, and it's fine if they don't have any
+	if _, err := f.Seek(0, 0); err != nil {
+		return true
+	}
+	exif, err := readJPEGEXIF(f)
+	if err != nil {
+		return true
+	}
+
+	// many cameras repeat the manufacturer in the model name, so don't say it
+	// twice if they do.
+	metadata.Camera = exif.Model
+	if !strings.HasPrefix(strings.ToLower(exif.Model), strings.ToLower(exif.Make)) {
+		metadata.Camera = strings.TrimSpace(exif.Make + " " + exif.Model)
+	}
+	if capturedAt, err := time.Parse("2006:01:02 15:04:05", exif.DateTimeOriginal); err == nil {
+		// EXIF doesn't record a time zone, so neither do we
+		metadata.CapturedAt = capturedAt.Format("2006-01-02T15:04:05") // ISO 8601
+	}
+	if exif.HasGPS {
+		metadata.Latitude = &exif.Latitude
+		metadata.Longitude = &exif.Longitude
+	}
+
+	return true
+}
+
+// fills in whatever media information ffprobe can find for the file
+func readProbeMetadata(filePath string, metadata *MetadataJSON) error {
+	out, err := runProcess(exec.Command(
+		"ffprobe",
+
+		// only complain if something actually goes wrong
+		"-v", "error",
+
+		// describe the container and all its streams as JSON
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+
+		filePath,
+	))
+	if err != nil {
+		return err
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return err
+	}
+
+	// still images report a nonsensical duration, so only keep it for media
+	// that actually plays.
+	mimeType := getMIMEType(filePath)
+	if strings.Index(mimeType, "image") != 0 {
+		metadata.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	}
+
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" && metadata.VideoCodec == "" {
+			metadata.VideoCodec = stream.CodecName
+			metadata.Width = stream.Width
+			metadata.Height = stream.Height
+		} else if stream.CodecType == "audio" && metadata.AudioCodec == "" {
+			metadata.AudioCodec = stream.CodecName
+
+			// some formats (Ogg, for one) put their tags on the stream
+			if metadata.Artist == "" {
+				metadata.Artist = getTag(stream.Tags, "artist")
+			}
+			if metadata.Album == "" {
+				metadata.Album = getTag(stream.Tags, "album")
+			}
+			if metadata.Title == "" {
+				metadata.Title = getTag(stream.Tags, "title")
+			}
+		}
+	}
+
+	if artist := getTag(probe.Format.Tags, "artist"); artist != "" {
+		metadata.Artist = artist
+	}
+	if album := getTag(probe.Format.Tags, "album"); album != "" {
+		metadata.Album = album
+	}
+	if title := getTag(probe.Format.Tags, "title"); title != "" {
+		metadata.Title = title
+	}
+
+	if metadata.CapturedAt == "" {
+		if created, err := time.Parse(time.RFC3339Nano, getTag(probe.Format.Tags, "creation_time")); err == nil {
+			metadata.CapturedAt = created.UTC().Format("2006-01-02T15:04:05Z") // ISO 8601
+		}
+	}
+
+	// a still image "codec" isn't interesting, the dimensions are what matter
+	if strings.Index(mimeType, "image") == 0 {
+		metadata.VideoCodec = ""
+	}
+
+	return nil
+}
+
+// returns media information (dimensions, EXIF, codecs, tags, etc.) for a file
+func getMetadata(w http.ResponseWriter, r *http.Request) {
+	rawPath := mux.Vars(r)["path"]
+	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// ensure the file exists
+	file, err := STORAGE.Stat(normalizedPath)
+	if err != nil || file.IsDir() {
+		// don't report the raw error in case we leak server directory information
+		http.Error(w, "Could not find "+rawPath, 404)
+		return
+	}
+
+	mimeType := getMIMEType(normalizedPath)
+	isImage := strings.Index(mimeType, "image") == 0
+	isAudio := strings.Index(mimeType, "audio") == 0
+	isVideo := strings.Index(mimeType, "video") == 0
+	if !isImage && !isAudio && !isVideo {
+		// HTTP 415 - Unsupported Media Type
+		http.Error(w, "Unsupported file type: "+mimeType, 415)
+		return
+	}
+
+	// probing files is slow, so reuse what we found for this version of the file
+	key := cacheKey(normalizedPath, file, "metadata")
+	if cached, ok := readCache(key); ok {
+		writeJSONResponse(w, json.RawMessage(cached))
+		return
+	}
+
+	// prefer reading images ourselves, falling back to ffprobe for formats Go
+	// doesn't understand and for all audio/video.
+	metadata := MetadataJSON{}
+	if !isImage || !readImageMetadata(normalizedPath, &metadata) {
+		// the file has to be on the local disk for ffprobe to read it
+		filePath, err := localPath(normalizedPath)
+		if err != nil {
+			// HTTP 501 - Not Implemented
+			http.Error(w, err.Error(), 501)
+			return
+		}
+
+		if err := readProbeMetadata(filePath, &metadata); err != nil {
+			http.Error(w, "Error reading metadata", 500)
+			return
+		}
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		http.Error(w, "Failed to generate JSON response", 500)
+		return
+	}
+
+	// failing to cache isn't fatal, we'll just have to probe it again later
+	if err := writeCache(key, data); err != nil {
+		log.Printf("Failed to cache metadata: %s", err)
+	}
+
+	writeJSONResponse(w, json.RawMessage(data))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	previewFrameWidth  = 160 // width of a single preview frame in pixels
+	previewFrameHeight = 90  // height of a single preview frame in pixels
+	previewColumns     = 10  // number of frames in each row of the sprite sheet
+	previewFramesCount = 10  // number of frames to generate by default
+	previewFramesMax   = 100 // most frames we're willing to generate
+)
+
+// a single frame within a preview sprite sheet
+type PreviewFrameJSON struct {
+	Time float64 `json:"time"`
+	X    int     `json:"x"`
+	Y    int     `json:"y"`
+}
+
+// describes where each frame of a preview sprite sheet lives so clients can
+// show the right one while scrubbing.
+type PreviewIndexJSON struct {
+	URL      string             `json:"url"`
+	Duration float64            `json:"duration"`
+	Width    int                `json:"width"`
+	Height   int                `json:"height"`
+	Frames   []PreviewFrameJSON `json:"frames"`
+}
+
+// returns the duration of the given video in seconds using ffprobe
+func getVideoDuration(filePath string, file os.FileInfo) (float64, error) {
+	key := cacheKey(filePath, file, "duration")
+
+	out, ok := readCache(key)
+	if !ok {
+		var err error
+		out, err = runProcess(exec.Command(
+			"ffprobe",
+
+			// only complain if something actually goes wrong
+			"-v", "error",
+
+			// print the container's duration and nothing else
+			"-show_entries", "format=duration",
+			"-of", "default=noprint_wrappers=1:nokey=1",
+
+			filePath,
+		))
+		if err != nil {
+			return 0, err
+		}
+
+		if err := writeCache(key, out); err != nil {
+			log.Printf("Failed to cache duration: %s", err)
+		}
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("Could not determine duration")
+	}
+
+	return duration, nil
+}
+
+// formats a number of seconds as a WebVTT timestamp, i.e. `hh:mm:ss.ttt`
+func formatVTTTimestamp(seconds float64) string {
+	millis := int64(seconds * 1000)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		millis/3600000, (millis/60000)%60, (millis/1000)%60, millis%1000)
+}
+
+// generates a sprite sheet of evenly-spaced frames from a video, or an index
+// describing where each frame lives in that sheet when the `format` query
+// parameter is `json` or `vtt`.
+func getPreview(w http.ResponseWriter, r *http.Request) {
+	rawPath := mux.Vars(r)["path"]
+	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// ensure the file exists
+	file, err := STORAGE.Stat(normalizedPath)
+	if err != nil || file.IsDir() {
+		// don't report the raw error in case we leak server directory information
+		http.Error(w, "Could not find "+rawPath, 404)
+		return
+	}
+
+	mimeType := getMIMEType(normalizedPath)
+	if strings.Index(mimeType, "video") != 0 {
+		// HTTP 415 - Unsupported Media Type
+		http.Error(w, "Unsupported file type: "+mimeType, 415)
+		return
+	}
+
+	// the file has to be on the local disk for ffmpeg to read it
+	filePath, err := localPath(normalizedPath)
+	if err != nil {
+		// HTTP 501 - Not Implemented
+		http.Error(w, err.Error(), 501)
+		return
+	}
+
+	// figure out how many frames we want, keeping it within reason
+	frames := previewFramesCount
+	if rawFrames := r.URL.Query().Get("frames"); rawFrames != "" {
+		frames, err = strconv.Atoi(rawFrames)
+		if err != nil || frames < 1 || frames > previewFramesMax {
+			http.Error(w, fmt.Sprintf("Frames must be between 1 and %d", previewFramesMax), 400)
+			return
+		}
+	}
+
+	duration, err := getVideoDuration(filePath, file)
+	if err != nil {
+		http.Error(w, "Error generating preview", 500)
+		return
+	}
+
+	// lay the frames out in rows of a fixed width
+	columns := previewColumns
+	if frames < columns {
+		columns = frames
+	}
+	rows := (frames + columns - 1) / columns
+	interval := duration / float64(frames)
+
+	// tell the browser to cache this response for a good while to lower load
+	w.Header().Add("Cache-Control", "max-age=3600")
+
+	format := r.URL.Query().Get("format")
+	if format == "json" || format == "vtt" {
+		index := PreviewIndexJSON{
+			URL:      r.URL.EscapedPath() + "?frames=" + strconv.Itoa(frames),
+			Duration: duration,
+			Width:    previewFrameWidth,
+			Height:   previewFrameHeight,
+			Frames:   make([]PreviewFrameJSON, frames),
+		}
+
+		for i := 0; i < frames; i++ {
+			index.Frames[i] = PreviewFrameJSON{
+				Time: float64(i) * interval,
+				X:    (i % columns) * previewFrameWidth,
+				Y:    (i / columns) * previewFrameHeight,
+			}
+		}
+
+		if format == "json" {
+			writeJSONResponse(w, index)
+			return
+		}
+
+		// build a WebVTT track where each cue points at its frame in the sheet
+		vtt := "WEBVTT\n"
+		for i, frame := range index.Frames {
+			end := math.Min(frame.Time+interval, duration)
+			vtt += fmt.Sprintf("\n%d\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+				i+1,
+				formatVTTTimestamp(frame.Time), formatVTTTimestamp(end),
+				index.URL, frame.X, frame.Y, index.Width, index.Height)
+		}
+
+		w.Header().Add("Content-Type", "text/vtt")
+		w.Write([]byte(vtt))
+		return
+	} else if format != "" {
+		http.Error(w, "Unsupported format: "+format, 400)
+		return
+	}
+
+	quality := 0.5 // quality of the image as fraction between 0 and 1
+
+	// serve a previously-generated sheet if we have one for this version of the
+	// file, since generating them is _very_ expensive.
+	key := cacheKey(normalizedPath, file, "preview", strconv.Itoa(frames), fmt.Sprint(quality))
+	if sprite, ok := readCache(key); ok {
+		w.Header().Add("Content-Type", "image/jpeg")
+		w.Write(sprite)
+		return
+	}
+
+	sprite, err := runProcess(exec.Command(
+		"ffmpeg",
+
+		// the file we're processing
+		"-i", filePath,
+
+		// sample frames evenly across the video, fit each one into a fixed-size
+		// box (padding the edges to preserve the aspect ratio), then tile them all
+		// into a single image.
+		"-vf", fmt.Sprintf(
+			"fps=%f,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+			1/interval,
+			previewFrameWidth, previewFrameHeight,
+			previewFrameWidth, previewFrameHeight,
+			columns, rows,
+		),
+
+		// the tile filter outputs a single frame once it's full
+		"-frames:v", "1",
+
+		// we want a JPEG (or "motion" JPEG, as it were)
+		"-f", "mjpeg",
+
+		// lower the quality. quality is between 1 and 31 where 1 is best
+		"-q:v", fmt.Sprintf("%0.f", 31*(1.0-quality)),
+
+		// output to stdout
+		"-",
+	))
+	if err != nil {
+		http.Error(w, "Error generating preview", 500)
+		return
+	}
+
+	// failing to cache isn't fatal, we'll just have to generate it again later
+	if err := writeCache(key, sprite); err != nil {
+		log.Printf("Failed to cache preview: %s", err)
+	}
+
+	w.Header().Add("Content-Type", "image/jpeg")
+	w.Write(sprite)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os/exec"
+)
+
+// limits how many external processes (gm, ffmpeg, etc.) we run at once so a
+// directory full of videos can't bring the machine to its knees. every slot
+// in the channel represents one running process.
+var processSlots chan struct{}
+
+// blocks until a process slot is available, then claims it
+func acquireProcessSlot() {
+	processSlots <- struct{}{}
+}
+
+// gives back a slot claimed by acquireProcessSlot
+func releaseProcessSlot() {
+	<-processSlots
+}
+
+// runs the given command once a process slot is available and returns
+// everything it wrote to stdout. if the command fails, its stderr output is
+// logged and the error is returned.
+func runProcess(cmd *exec.Cmd) ([]byte, error) {
+	acquireProcessSlot()
+	defer releaseProcessSlot()
+
+	var out bytes.Buffer
+	var eOut bytes.Buffer
+
+	cmd.Stdout = &out
+	cmd.Stderr = &eOut
+
+	err := cmd.Run()
+	if err != nil {
+		log.Printf("%s", eOut.String())
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,821 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Namespace      = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimestampFmt   = "2006-01-02T15:04:05.000Z"
+	s3DefaultMaxKeys = 1000
+	s3MaxParts       = 10000
+	s3UploadsDir     = "s3-uploads"
+	s3UploadLifetime = 24 * time.Hour
+)
+
+// the error document S3 returns with every failed request
+type s3ErrorXML struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+type s3BucketXML struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListBucketsXML struct {
+	XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+	Xmlns   string        `xml:"xmlns,attr"`
+	OwnerID string        `xml:"Owner>ID"`
+	Buckets []s3BucketXML `xml:"Buckets>Bucket"`
+}
+
+type s3ObjectXML struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3PrefixXML struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListObjectsXML struct {
+	XMLName               xml.Name      `xml:"ListBucketResult"`
+	Xmlns                 string        `xml:"xmlns,attr"`
+	Name                  string        `xml:"Name"`
+	Prefix                string        `xml:"Prefix"`
+	Delimiter             string        `xml:"Delimiter,omitempty"`
+	MaxKeys               int           `xml:"MaxKeys"`
+	KeyCount              int           `xml:"KeyCount"`
+	IsTruncated           bool          `xml:"IsTruncated"`
+	EncodingType          string        `xml:"EncodingType,omitempty"`
+	ContinuationToken     string        `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string        `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string        `xml:"StartAfter,omitempty"`
+	Contents              []s3ObjectXML `xml:"Contents"`
+	CommonPrefixes        []s3PrefixXML `xml:"CommonPrefixes"`
+}
+
+type s3InitiateUploadXML struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteUploadRequestXML struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteUploadXML struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+// writes an S3-style XML error response
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+
+	// HEAD responses can't have a body
+	if r.Method == "HEAD" {
+		return
+	}
+
+	data, _ := xml.Marshal(s3ErrorXML{Code: code, Message: message, Resource: r.URL.Path})
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// writes an S3-style XML response
+func writeS3Response(w http.ResponseWriter, r *http.Request, data interface{}) {
+	out, err := xml.Marshal(data)
+	if err != nil {
+		writeS3Error(w, r, 500, "InternalError", "Failed to generate response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+// returns an ETag for a file on disk. objects written through S3 keep the ETag
+// they were stored with, and files we've already hashed use their MD5.
+// computing a real MD5 for every other file would mean reading all of them, so
+// theirs is derived from the file's version instead, with a `-0` suffix like a
+// multipart ETag has so clients don't mistake it for the MD5 of the contents.
+func s3FileETag(filePath string, file os.FileInfo) string {
+	if etag, ok := readCache(cacheKey(filePath, file, "etag")); ok {
+		return string(etag)
+	}
+	if sum, ok := readCache(checksumCacheKey(filePath, file, "md5")); ok {
+		return `"` + hex.EncodeToString(sum) + `"`
+	}
+
+	return `"` + cacheKey(filePath, file, "etag")[:32] + `-0"`
+}
+
+// remembers the ETag an object was stored with, so later requests for it
+// return the same one. failing to isn't fatal, the object just gets a derived
+// ETag instead.
+func s3StoreETag(objectPath string, etag string) {
+	if file, err := STORAGE.Stat(objectPath); err == nil {
+		writeCache(cacheKey(objectPath, file, "etag"), []byte(etag))
+	}
+}
+
+// returns the directory backing a bucket, if the bucket exists
+func s3BucketPath(bucket string) (string, bool) {
+	if bucket == "" || strings.HasPrefix(bucket, ".") {
+		return "", false
+	}
+
+	bucketPath, err := normalizePathUnderRoot(ROOT, bucket)
+	if err != nil || filepath.Dir(bucketPath) != ROOT {
+		return "", false
+	}
+
+	dir, err := STORAGE.Stat(bucketPath)
+	if err != nil || !dir.IsDir() {
+		return "", false
+	}
+
+	return bucketPath, true
+}
+
+// returns the directory multipart uploads are staged in
+func s3UploadPath(uploadID string) (string, bool) {
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", false
+	}
+
+	return filepath.Join(CACHE_ROOT, s3UploadsDir, uploadID), true
+}
+
+// serves the S3-compatible API. buckets are the directories at the top level
+// of the root, and objects are the files within them.
+func serveS3(w http.ResponseWriter, r *http.Request) {
+	sig, err := authenticateS3(r)
+	if err != nil {
+		writeS3Error(w, r, 403, "AccessDenied", err.Error())
+		return
+	}
+
+	// split the path into the bucket and the key within it
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	if bucket == "" {
+		if r.Method == "GET" {
+			s3ListBuckets(w, r)
+		} else {
+			writeS3Error(w, r, 405, "MethodNotAllowed", "Method not allowed")
+		}
+		return
+	}
+
+	// creating a bucket just creates a directory at the top level
+	if key == "" && r.Method == "PUT" {
+		bucketPath, err := normalizePathUnderRoot(ROOT, bucket)
+		if err != nil || filepath.Dir(bucketPath) != ROOT || strings.HasPrefix(bucket, ".") {
+			writeS3Error(w, r, 400, "InvalidBucketName", "Invalid bucket name")
+			return
+		}
+		if _, err := STORAGE.Lstat(bucketPath); err == nil {
+			writeS3Error(w, r, 409, "BucketAlreadyExists", "Bucket already exists")
+			return
+		}
+		if err := STORAGE.MkdirAll(bucketPath); err != nil {
+			writeS3Error(w, r, 409, "BucketAlreadyExists", "Bucket already exists")
+			return
+		}
+		return
+	}
+
+	bucketPath, ok := s3BucketPath(bucket)
+	if !ok {
+		writeS3Error(w, r, 404, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	query := r.URL.Query()
+
+	if key == "" {
+		switch r.Method {
+		case "GET":
+			s3ListObjects(w, r, bucket, bucketPath)
+		case "HEAD":
+			// the bucket exists, which is all HEAD wants to know
+		default:
+			writeS3Error(w, r, 405, "MethodNotAllowed", "Method not allowed")
+		}
+		return
+	}
+
+	objectPath, err := normalizePathUnderRoot(bucketPath, key)
+	if err != nil || objectPath == bucketPath {
+		writeS3Error(w, r, 400, "InvalidArgument", "Invalid key")
+		return
+	}
+
+	_, hasUploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == "POST" && hasUploads:
+		s3CreateUpload(w, r, bucket, key)
+	case r.Method == "PUT" && uploadID != "":
+		s3UploadPart(w, r, sig, bucket, key, uploadID)
+	case r.Method == "POST" && uploadID != "":
+		s3CompleteUpload(w, r, bucket, key, objectPath, uploadID)
+	case r.Method == "DELETE" && uploadID != "":
+		s3AbortUpload(w, r, bucket, key, uploadID)
+	case r.Method == "GET" || r.Method == "HEAD":
+		s3GetObject(w, r, objectPath)
+	case r.Method == "PUT":
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			writeS3Error(w, r, 501, "NotImplemented", "Copying objects is not supported")
+			return
+		}
+		s3PutObject(w, r, sig, key, objectPath)
+	case r.Method == "DELETE":
+		s3DeleteObject(w, r, sig, key, objectPath)
+	default:
+		writeS3Error(w, r, 405, "MethodNotAllowed", "Method not allowed")
+	}
+}
+
+// lists every bucket, i.e. every directory at the top level of the root
+func s3ListBuckets(w http.ResponseWriter, r *http.Request) {
+	children, err := STORAGE.ReadDir(ROOT)
+	if err != nil {
+		writeS3Error(w, r, 500, "InternalError", "Failed to list buckets")
+		return
+	}
+
+	result := s3ListBucketsXML{Xmlns: s3Namespace, OwnerID: "bucket", Buckets: []s3BucketXML{}}
+	for _, child := range children {
+		if child.IsDir() && !strings.HasPrefix(child.Name(), ".") {
+			result.Buckets = append(result.Buckets, s3BucketXML{
+				child.Name(),
+				child.ModTime().UTC().Format(s3TimestampFmt),
+			})
+		}
+	}
+
+	writeS3Response(w, r, result)
+}
+
+// implements ListObjectsV2
+func s3ListObjects(w http.ResponseWriter, r *http.Request, bucket string, bucketPath string) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		writeS3Error(w, r, 501, "NotImplemented", "Only ListObjectsV2 is supported")
+		return
+	}
+
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	encodeURL := query.Get("encoding-type") == "url"
+
+	maxKeys := s3DefaultMaxKeys
+	if rawMaxKeys := query.Get("max-keys"); rawMaxKeys != "" {
+		var err error
+		maxKeys, err = strconv.Atoi(rawMaxKeys)
+		if err != nil || maxKeys < 0 {
+			writeS3Error(w, r, 400, "InvalidArgument", "Invalid max-keys")
+			return
+		}
+		if maxKeys > s3DefaultMaxKeys {
+			maxKeys = s3DefaultMaxKeys
+		}
+	}
+
+	// listing resumes after whichever of these comes later
+	marker := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		decoded, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			writeS3Error(w, r, 400, "InvalidArgument", "Invalid continuation token")
+			return
+		}
+		if string(decoded) > marker {
+			marker = string(decoded)
+		}
+	}
+
+	// only walk the part of the tree the prefix could match
+	startDir := bucketPath
+	if dir := prefix[:strings.LastIndex(prefix, "/")+1]; dir != "" {
+		if dirPath, err := normalizePathUnderRoot(bucketPath, dir); err == nil {
+			startDir = dirPath
+		}
+	}
+
+	files := map[string]os.FileInfo{}
+	keys := []string{}
+	walkStorage(STORAGE, startDir, func(fullPath string, file os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		relPath, _ := filepath.Rel(bucketPath, fullPath)
+		key := filepath.ToSlash(relPath)
+
+		// skip the trash and temporary files, which nobody should see
+		if isReservedName(file.Name()) {
+			if file.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// and directories that can't contain anything matching the prefix
+		if file.IsDir() {
+			if relPath != "." && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if file.Mode().IsRegular() && strings.HasPrefix(key, prefix) && key > marker {
+			files[key] = file
+			keys = append(keys, key)
+		}
+		return nil
+	})
+
+	// S3 lists keys in byte order, which isn't quite the order we walked them
+	sort.Strings(keys)
+
+	encode := func(s string) string {
+		if encodeURL {
+			return url.QueryEscape(s)
+		}
+		return s
+	}
+
+	result := s3ListObjectsXML{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            encode(prefix),
+		Delimiter:         encode(delimiter),
+		MaxKeys:           maxKeys,
+		ContinuationToken: query.Get("continuation-token"),
+		StartAfter:        encode(query.Get("start-after")),
+		Contents:          []s3ObjectXML{},
+		CommonPrefixes:    []s3PrefixXML{},
+	}
+	if encodeURL {
+		result.EncodingType = "url"
+	}
+
+	last := ""
+	for _, key := range keys {
+		// a marker that's a common prefix means we already listed everything in it
+		if delimiter != "" && strings.HasSuffix(marker, delimiter) && strings.HasPrefix(key, marker) {
+			continue
+		}
+
+		// roll keys containing the delimiter up into common prefixes
+		commonPrefix := ""
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix = key[:len(prefix)+i+len(delimiter)]
+				if commonPrefix == last {
+					continue
+				}
+			}
+		}
+
+		if result.KeyCount >= maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+			break
+		}
+
+		if commonPrefix != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3PrefixXML{encode(commonPrefix)})
+			last = commonPrefix
+		} else {
+			file := files[key]
+			result.Contents = append(result.Contents, s3ObjectXML{
+				encode(key),
+				file.ModTime().UTC().Format(s3TimestampFmt),
+				s3FileETag(filepath.Join(bucketPath, key), file),
+				file.Size(),
+				"STANDARD",
+			})
+			last = key
+		}
+		result.KeyCount++
+	}
+
+	writeS3Response(w, r, result)
+}
+
+// implements GetObject and HeadObject, including range requests
+func s3GetObject(w http.ResponseWriter, r *http.Request, objectPath string) {
+	file, err := STORAGE.Stat(objectPath)
+	if err != nil || !file.Mode().IsRegular() {
+		writeS3Error(w, r, 404, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+
+	f, err := STORAGE.Open(objectPath)
+	if err != nil {
+		writeS3Error(w, r, 404, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+	defer f.Close()
+
+	if mimeType := getMIMEType(objectPath); mimeType != "" {
+		w.Header().Set("Content-Type", mimeType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("ETag", s3FileETag(objectPath, file))
+
+	http.ServeContent(w, r, file.Name(), file.ModTime(), f)
+}
+
+// copies a payload into a temporary file in the given directory of the given
+// storage, returning the file's name and the MD5 of its contents. the caller
+// is responsible for moving the file into place or removing it.
+func s3WriteTemp(storage Storage, dir string, payload io.Reader) (string, []byte, error) {
+	if err := storage.MkdirAll(dir); err != nil {
+		return "", nil, err
+	}
+
+	tempPath := tempPathIn(dir, "s3-upload")
+
+	f, err := storage.Create(tempPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, h), payload)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		storage.Remove(tempPath)
+		return "", nil, err
+	}
+
+	return tempPath, h.Sum(nil), nil
+}
+
+// implements PutObject. keys ending in a `/` create directories, since that's
+// how most tools represent empty folders.
+func s3PutObject(w http.ResponseWriter, r *http.Request, sig *s3Signature, key string, objectPath string) {
+	if strings.HasSuffix(key, "/") {
+		if err := STORAGE.MkdirAll(objectPath); err != nil {
+			writeS3Error(w, r, 409, "InvalidArgument", "Could not create folder")
+			return
+		}
+
+		empty := md5.Sum(nil)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(empty[:])+`"`)
+		return
+	}
+
+	file, err := STORAGE.Stat(objectPath)
+	if err == nil && file.IsDir() {
+		writeS3Error(w, r, 409, "InvalidArgument", "A folder exists with that key")
+		return
+	}
+	exists := err == nil
+
+	// replace whatever a link here leads to, rather than the link itself
+	targetPath := replacedPath(objectPath)
+	if err := STORAGE.MkdirAll(filepath.Dir(targetPath)); err != nil {
+		writeS3Error(w, r, 409, "InvalidRequest", "An object exists where a folder is needed")
+		return
+	}
+
+	tempPath, sum, err := s3WriteTemp(STORAGE, filepath.Dir(targetPath), sig.payloadReader(r))
+	if err != nil {
+		writeS3Error(w, r, 400, "BadDigest", "Failed to receive object")
+		return
+	}
+
+	// check the content against the MD5 the client sent, if any
+	if expected := r.Header.Get("Content-MD5"); expected != "" && expected != base64.StdEncoding.EncodeToString(sum) {
+		STORAGE.Remove(tempPath)
+		writeS3Error(w, r, 400, "BadDigest", "Content-MD5 does not match")
+		return
+	}
+
+	if exists {
+		if err := keepPermissions(tempPath, file); err != nil {
+			STORAGE.Remove(tempPath)
+			writeS3Error(w, r, 500, "InternalError", "Failed to store object")
+			return
+		}
+	}
+
+	if err := saveVersion(objectPath); err != nil {
+		STORAGE.Remove(tempPath)
+		writeS3Error(w, r, 500, "InternalError", "Failed to keep the previous version")
+		return
+	}
+
+	if err := STORAGE.Rename(tempPath, targetPath); err != nil {
+		STORAGE.Remove(tempPath)
+		writeS3Error(w, r, 500, "InternalError", "Failed to store object")
+		return
+	}
+
+	etag := `"` + hex.EncodeToString(sum) + `"`
+	s3StoreETag(objectPath, etag)
+	w.Header().Set("ETag", etag)
+}
+
+// implements DeleteObject. keys ending in a `/` name the folders PutObject
+// creates for them, which are removed if they're empty. one that isn't still
+// holds other objects, which deleting the folder's own key doesn't touch in S3
+// either, so it's left where it is.
+func s3DeleteObject(w http.ResponseWriter, r *http.Request, sig *s3Signature, key string, objectPath string) {
+	file, err := STORAGE.Lstat(objectPath)
+	if err != nil || file.IsDir() != strings.HasSuffix(key, "/") {
+		// deleting something that doesn't exist isn't an error in S3
+		w.WriteHeader(204)
+		return
+	}
+
+	if file.IsDir() {
+		if children, err := STORAGE.ReadDir(objectPath); err != nil || len(children) > 0 {
+			w.WriteHeader(204)
+			return
+		}
+	}
+
+	ctx := withDeleter(r.Context(), "s3 "+sig.accessKey)
+	if err := deletePath(ctx, objectPath); err != nil {
+		writeS3Error(w, r, 500, "InternalError", "Failed to delete object")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// reads which bucket and key an upload is for, returning false if the upload
+// doesn't exist or belongs to another object.
+func s3CheckUpload(uploadID string, bucket string, key string) (string, bool) {
+	uploadPath, ok := s3UploadPath(uploadID)
+	if !ok {
+		return "", false
+	}
+
+	target, err := ioutil.ReadFile(filepath.Join(uploadPath, "target"))
+	if err != nil || string(target) != bucket+"/"+key {
+		return "", false
+	}
+
+	return uploadPath, true
+}
+
+// implements CreateMultipartUpload
+func s3CreateUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	uploadID := hex.EncodeToString(id)
+
+	uploadPath, _ := s3UploadPath(uploadID)
+	if err := os.MkdirAll(uploadPath, 0755); err != nil {
+		writeS3Error(w, r, 500, "InternalError", "Failed to create upload")
+		return
+	}
+
+	// remember which object the parts are for
+	if err := ioutil.WriteFile(filepath.Join(uploadPath, "target"), []byte(bucket+"/"+key), 0644); err != nil {
+		os.RemoveAll(uploadPath)
+		writeS3Error(w, r, 500, "InternalError", "Failed to create upload")
+		return
+	}
+
+	writeS3Response(w, r, s3InitiateUploadXML{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+	})
+}
+
+// implements UploadPart
+func s3UploadPart(w http.ResponseWriter, r *http.Request, sig *s3Signature, bucket string, key string, uploadID string) {
+	uploadPath, ok := s3CheckUpload(uploadID, bucket, key)
+	if !ok {
+		writeS3Error(w, r, 404, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxParts {
+		writeS3Error(w, r, 400, "InvalidArgument", "Invalid part number")
+		return
+	}
+
+	// parts are staged in the cache, which is always on the local disk
+	tempPath, sum, err := s3WriteTemp(localStorage{}, uploadPath, sig.payloadReader(r))
+	if err != nil {
+		writeS3Error(w, r, 400, "BadDigest", "Failed to receive part")
+		return
+	}
+
+	// keep the part's MD5 alongside it so we can check the ETags the client
+	// sends when it completes the upload.
+	partPath := filepath.Join(uploadPath, fmt.Sprintf("part-%05d", partNumber))
+	if err := os.Rename(tempPath, partPath); err != nil {
+		os.Remove(tempPath)
+		writeS3Error(w, r, 500, "InternalError", "Failed to store part")
+		return
+	}
+	if err := ioutil.WriteFile(partPath+".md5", []byte(hex.EncodeToString(sum)), 0644); err != nil {
+		writeS3Error(w, r, 500, "InternalError", "Failed to store part")
+		return
+	}
+
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+}
+
+// implements CompleteMultipartUpload, joining the parts into the object
+func s3CompleteUpload(w http.ResponseWriter, r *http.Request, bucket string, key string, objectPath string, uploadID string) {
+	uploadPath, ok := s3CheckUpload(uploadID, bucket, key)
+	if !ok {
+		writeS3Error(w, r, 404, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	var request s3CompleteUploadRequestXML
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1024*1024)).Decode(&request); err != nil || len(request.Parts) == 0 {
+		writeS3Error(w, r, 400, "MalformedXML", "Invalid part list")
+		return
+	}
+
+	// open every part up front so we know they're all there and match
+	readers := []io.Reader{}
+	for i, part := range request.Parts {
+		if i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber {
+			writeS3Error(w, r, 400, "InvalidPartOrder", "Parts must be in ascending order")
+			return
+		}
+
+		partPath := filepath.Join(uploadPath, fmt.Sprintf("part-%05d", part.PartNumber))
+		partSum, err := ioutil.ReadFile(partPath + ".md5")
+		if err != nil || string(partSum) != strings.Trim(part.ETag, `"`) {
+			writeS3Error(w, r, 400, "InvalidPart", fmt.Sprintf("Part %d was never uploaded", part.PartNumber))
+			return
+		}
+
+		f, err := os.Open(partPath)
+		if err != nil {
+			writeS3Error(w, r, 400, "InvalidPart", fmt.Sprintf("Part %d was never uploaded", part.PartNumber))
+			return
+		}
+		defer f.Close()
+
+		readers = append(readers, bufio.NewReader(f))
+	}
+
+	targetPath := replacedPath(objectPath)
+	if err := STORAGE.MkdirAll(filepath.Dir(targetPath)); err != nil {
+		writeS3Error(w, r, 409, "InvalidRequest", "An object exists where a folder is needed")
+		return
+	}
+
+	tempPath, _, err := s3WriteTemp(STORAGE, filepath.Dir(targetPath), io.MultiReader(readers...))
+	if err != nil {
+		writeS3Error(w, r, 500, "InternalError", "Failed to assemble object")
+		return
+	}
+
+	if file, err := STORAGE.Stat(objectPath); err == nil && file.Mode().IsRegular() {
+		if err := keepPermissions(tempPath, file); err != nil {
+			STORAGE.Remove(tempPath)
+			writeS3Error(w, r, 500, "InternalError", "Failed to assemble object")
+			return
+		}
+	}
+
+	if err := saveVersion(objectPath); err != nil {
+		STORAGE.Remove(tempPath)
+		writeS3Error(w, r, 500, "InternalError", "Failed to keep the previous version")
+		return
+	}
+
+	if err := STORAGE.Rename(tempPath, targetPath); err != nil {
+		STORAGE.Remove(tempPath)
+		writeS3Error(w, r, 500, "InternalError", "Failed to store object")
+		return
+	}
+	os.RemoveAll(uploadPath)
+
+	// multipart ETags are the MD5 of the parts' MD5s, followed by the count
+	h := md5.New()
+	for _, part := range request.Parts {
+		partSum, _ := hex.DecodeString(strings.Trim(part.ETag, `"`))
+		h.Write(partSum)
+	}
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(h.Sum(nil)), len(request.Parts))
+	s3StoreETag(objectPath, etag)
+
+	writeS3Response(w, r, s3CompleteUploadXML{
+		Xmlns:  s3Namespace,
+		Bucket: bucket,
+		Key:    key,
+		ETag:   etag,
+	})
+}
+
+// implements AbortMultipartUpload
+func s3AbortUpload(w http.ResponseWriter, r *http.Request, bucket string, key string, uploadID string) {
+	uploadPath, ok := s3CheckUpload(uploadID, bucket, key)
+	if !ok {
+		writeS3Error(w, r, 404, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	os.RemoveAll(uploadPath)
+	w.WriteHeader(204)
+}
+
+// periodically removes multipart uploads that were never completed
+func cleanupS3Uploads() {
+	for range time.Tick(time.Hour) {
+		uploadsPath := filepath.Join(CACHE_ROOT, s3UploadsDir)
+		uploads, err := ioutil.ReadDir(uploadsPath)
+		if err != nil {
+			continue
+		}
+
+		for _, upload := range uploads {
+			if time.Since(upload.ModTime()) > s3UploadLifetime {
+				if err := os.RemoveAll(filepath.Join(uploadsPath, upload.Name())); err != nil {
+					log.Printf("Failed to remove stale upload %s: %s", upload.Name(), err)
+				}
+			}
+		}
+	}
+}
+
+// reads access keys from a file with one `ACCESS_KEY SECRET_KEY` pair per
+// line. blank lines and lines starting with `#` are ignored.
+func loadS3Keys(keysPath string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(keysPath)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid key on line %d of %s", i+1, keysPath)
+		}
+		keys[fields[0]] = fields[1]
+	}
+
+	return keys, nil
+}
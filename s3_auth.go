@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// access keys allowed to use the S3 API, mapped to their secret keys
+var S3_KEYS = map[string]string{}
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3TimeFormat      = "20060102T150405Z"
+	s3MaxClockSkew    = 15 * time.Minute
+	s3MaxExpires      = 7 * 24 * time.Hour // the longest a presigned URL may last
+	s3MaxChunkSize    = 16 * 1024 * 1024
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyHash       = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// a request whose signature we've verified, along with what we need to verify
+// its payload as it's read.
+type s3Signature struct {
+	accessKey   string
+	signingKey  []byte
+	amzDate     string
+	scope       string
+	signature   string
+	payloadHash string // the x-amz-content-sha256 value the client signed
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// URI-encodes a string the way SigV4 requires, which differs just enough from
+// Go's own escaping to matter. slashes are left alone in paths.
+func s3URIEncode(s string, isPath bool) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (isPath && b == '/') {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+
+	return buf.String()
+}
+
+// builds the canonical query string, leaving out the signature itself if the
+// request was presigned.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		if key != "X-Amz-Signature" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3URIEncode(key, false)+"="+s3URIEncode(value, false))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// builds the canonical headers block for the given signed headers
+func s3CanonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var buf bytes.Buffer
+	for _, name := range signedHeaders {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			value = strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")
+		}
+
+		// collapse runs of whitespace, as the spec requires
+		buf.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	return buf.String()
+}
+
+// computes the signature for a request given its signing details
+func s3Sign(r *http.Request, signingKey []byte, amzDate, scope string, signedHeaders []string, payloadHash string) string {
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s3URIEncode(r.URL.Path, true),
+		s3CanonicalQuery(r.URL.Query()),
+		s3CanonicalHeaders(r, signedHeaders),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	return hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+}
+
+// verifies a request's SigV4 signature, either from its Authorization header
+// or from its query string if it was presigned. returns the details needed to
+// verify the payload once it's read.
+func authenticateS3(r *http.Request) (*s3Signature, error) {
+	query := r.URL.Query()
+
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	presigned := query.Get("X-Amz-Algorithm") != ""
+
+	// the headers that must be signed so a signature can't be replayed against
+	// another server, or with a different date or payload
+	requiredHeaders := []string{"host"}
+
+	if presigned {
+		if query.Get("X-Amz-Algorithm") != s3Algorithm {
+			return nil, fmt.Errorf("Unsupported signing algorithm")
+		}
+
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = s3UnsignedPayload
+	} else {
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, s3Algorithm+" ") {
+			return nil, fmt.Errorf("Missing or unsupported authorization")
+		}
+
+		// the rest is a comma-separated list of key=value pairs
+		for _, part := range strings.Split(strings.TrimPrefix(authorization, s3Algorithm+" "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return nil, fmt.Errorf("Missing content hash")
+		}
+
+		requiredHeaders = append(requiredHeaders, "x-amz-content-sha256", "x-amz-date")
+	}
+
+	// the credential looks like `KEY/20150830/us-east-1/s3/aws4_request`
+	credentialParts := strings.SplitN(credential, "/", 2)
+	if len(credentialParts) != 2 || signature == "" || signedHeaders == "" {
+		return nil, fmt.Errorf("Malformed authorization")
+	}
+	scope := credentialParts[1]
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 || scopeParts[3] != "aws4_request" {
+		return nil, fmt.Errorf("Malformed credential scope")
+	}
+
+	headerNames := strings.Split(signedHeaders, ";")
+	for _, required := range requiredHeaders {
+		found := false
+		for _, name := range headerNames {
+			if name == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Header %s must be signed", required)
+		}
+	}
+
+	secret, ok := S3_KEYS[credentialParts[0]]
+	if !ok {
+		return nil, fmt.Errorf("Unknown access key")
+	}
+
+	// make sure the request is recent (or, if presigned, hasn't expired)
+	signedAt, err := time.Parse(s3TimeFormat, amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, scopeParts[0]) {
+		return nil, fmt.Errorf("Invalid request date")
+	}
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || expires > int(s3MaxExpires/time.Second) {
+			return nil, fmt.Errorf("Invalid expiration")
+		}
+		if time.Now().After(signedAt.Add(time.Duration(expires) * time.Second)) {
+			return nil, fmt.Errorf("Request has expired")
+		}
+	} else if skew := time.Since(signedAt); skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+		return nil, fmt.Errorf("Request time is too skewed")
+	}
+
+	signingKey := []byte("AWS4" + secret)
+	for _, part := range scopeParts {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+
+	expected := s3Sign(r, signingKey, amzDate, scope, headerNames, payloadHash)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) != 1 {
+		return nil, fmt.Errorf("Signature does not match")
+	}
+
+	return &s3Signature{credentialParts[0], signingKey, amzDate, scope, signature, payloadHash}, nil
+}
+
+// returns a reader for the request's payload that fails if the payload doesn't
+// match what the client signed. for payloads sent in signed chunks this also
+// strips the chunk framing.
+func (sig *s3Signature) payloadReader(r *http.Request) io.Reader {
+	switch {
+	case strings.HasPrefix(sig.payloadHash, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"):
+		return &s3ChunkedReader{r: bufio.NewReader(r.Body), sig: sig, prevSignature: sig.signature, verify: true}
+	case strings.HasPrefix(sig.payloadHash, "STREAMING-UNSIGNED-PAYLOAD"):
+		return &s3ChunkedReader{r: bufio.NewReader(r.Body), sig: sig}
+	case sig.payloadHash == s3UnsignedPayload:
+		return r.Body
+	}
+
+	return &s3HashingReader{r: r.Body, h: sha256.New(), expected: sig.payloadHash}
+}
+
+// verifies the SHA-256 hash of everything read through it once it's done
+type s3HashingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected string
+}
+
+func (s *s3HashingReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(s.h.Sum(nil)) != s.expected {
+		return n, fmt.Errorf("Content does not match signed hash")
+	}
+	return n, err
+}
+
+// decodes a payload sent with `aws-chunked` encoding, verifying each chunk's
+// signature if the payload is signed.
+type s3ChunkedReader struct {
+	r             *bufio.Reader
+	sig           *s3Signature
+	prevSignature string
+	verify        bool
+	buf           []byte
+	done          bool
+}
+
+func (c *s3ChunkedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// reads the next chunk into the buffer. each chunk looks like
+// `<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n`, with a final empty
+// chunk followed by any trailing headers and a blank line.
+func (c *s3ChunkedReader) readChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("Malformed chunk")
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	parts := strings.SplitN(line, ";", 2)
+	size, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil || size < 0 || size > s3MaxChunkSize {
+		return fmt.Errorf("Malformed chunk size")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return fmt.Errorf("Truncated chunk")
+	}
+
+	if c.verify {
+		chunkSignature := ""
+		if len(parts) == 2 {
+			chunkSignature = strings.TrimPrefix(parts[1], "chunk-signature=")
+		}
+
+		// each chunk's signature is chained to the one before it
+		stringToSign := strings.Join([]string{
+			s3Algorithm + "-PAYLOAD",
+			c.sig.amzDate,
+			c.sig.scope,
+			c.prevSignature,
+			s3EmptyHash,
+			sha256Hex(data),
+		}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(c.sig.signingKey, stringToSign))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(chunkSignature)) != 1 {
+			return fmt.Errorf("Chunk signature does not match")
+		}
+		c.prevSignature = chunkSignature
+	}
+
+	if size == 0 {
+		// skip any trailing headers (checksums and the like) up to the blank line
+		for {
+			trailer, err := c.r.ReadString('\n')
+			if err != nil || strings.TrimRight(trailer, "\r\n") == "" {
+				break
+			}
+		}
+
+		c.done = true
+		return nil
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, c.r, 2); err != nil {
+		return fmt.Errorf("Truncated chunk")
+	}
+
+	c.buf = data
+	return nil
+}
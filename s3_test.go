@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signs a request with the test key the same way S3 clients do
+func signTestS3Request(r *http.Request, payload []byte) {
+	amzDate := time.Now().UTC().Format(s3TimeFormat)
+	scope := amzDate[:8] + "/us-east-1/s3/aws4_request"
+	payloadHash := sha256Hex(payload)
+
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signingKey := []byte("AWS4" + "secret")
+	for _, part := range strings.Split(scope, "/") {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	signature := s3Sign(r, signingKey, amzDate, scope, signedHeaders, payloadHash)
+	r.Header.Set("Authorization", s3Algorithm+" Credential=key/"+scope+
+		", SignedHeaders="+strings.Join(signedHeaders, ";")+", Signature="+signature)
+}
+
+// sends a signed request to the S3 API
+func serveTestS3Request(method string, url string, payload []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, bytes.NewReader(payload))
+	signTestS3Request(r, payload)
+
+	w := httptest.NewRecorder()
+	serveS3(w, r)
+	return w
+}
+
+func useTestS3Keys(t *testing.T) {
+	oldKeys := S3_KEYS
+	t.Cleanup(func() { S3_KEYS = oldKeys })
+	S3_KEYS = map[string]string{"key": "secret"}
+}
+
+func TestS3Objects(t *testing.T) {
+	storage := useMemoryStorage(t)
+	useTestS3Keys(t)
+
+	if w := serveTestS3Request("PUT", "/photos", nil); w.Code != 200 {
+		t.Fatalf("creating a bucket: %d %s", w.Code, w.Body.String())
+	}
+	if file, err := storage.Stat("/bucket/photos"); err != nil || !file.IsDir() {
+		t.Fatalf("bucket wasn't created as a directory: %v", err)
+	}
+
+	w := serveTestS3Request("PUT", "/photos/2020/cat.txt", []byte("meow"))
+	if w.Code != 200 {
+		t.Fatalf("putting an object: %d %s", w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	if data, err := readStorageFile(storage, "/bucket/photos/2020/cat.txt"); err != nil || string(data) != "meow" {
+		t.Fatalf("object wasn't stored: %q %v", data, err)
+	}
+
+	w = serveTestS3Request("GET", "/photos/2020/cat.txt", nil)
+	if w.Code != 200 || w.Body.String() != "meow" {
+		t.Errorf("getting an object: %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("expected the ETag the object was stored with, %s, got %s", etag, got)
+	}
+
+	w = serveTestS3Request("GET", "/photos?list-type=2", nil)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "<Key>2020/cat.txt</Key>") {
+		t.Errorf("listing objects: %d %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "<ETag>&#34;"+strings.Trim(etag, `"`)+"&#34;</ETag>") {
+		t.Errorf("expected the listing to use the stored ETag %s: %s", etag, w.Body.String())
+	}
+
+	// files that didn't come through S3 get an ETag that can't pass for an MD5
+	writeTestFile(t, storage, "/bucket/photos/dog.txt", []byte("woof"))
+	w = serveTestS3Request("HEAD", "/photos/dog.txt", nil)
+	if got := w.Header().Get("ETag"); w.Code != 200 || !strings.HasSuffix(got, `-0"`) {
+		t.Errorf("expected a derived ETag for a file written elsewhere, got %d %s", w.Code, got)
+	}
+
+	if w := serveTestS3Request("DELETE", "/photos/2020/cat.txt", nil); w.Code != 204 {
+		t.Errorf("deleting an object: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := storage.Lstat("/bucket/photos/2020/cat.txt"); err == nil {
+		t.Errorf("object wasn't deleted")
+	}
+
+	w = serveTestS3Request("GET", "/photos/2020/cat.txt", nil)
+	if w.Code != 404 {
+		t.Errorf("expected 404 for a deleted object, got %d", w.Code)
+	}
+}
+
+func TestS3RejectsBadRequests(t *testing.T) {
+	storage := useMemoryStorage(t)
+	useTestS3Keys(t)
+	writeTestFile(t, storage, "/bucket/photos/cat.txt", []byte("meow"))
+
+	// unsigned
+	w := httptest.NewRecorder()
+	serveS3(w, httptest.NewRequest("GET", "/photos/cat.txt", nil))
+	if w.Code != 403 {
+		t.Errorf("expected 403 for an unsigned request, got %d", w.Code)
+	}
+
+	// signed by someone else
+	r := httptest.NewRequest("GET", "/photos/cat.txt", nil)
+	signTestS3Request(r, nil)
+	S3_KEYS = map[string]string{"key": "another secret"}
+	w = httptest.NewRecorder()
+	serveS3(w, r)
+	if w.Code != 403 {
+		t.Errorf("expected 403 for a bad signature, got %d", w.Code)
+	}
+	S3_KEYS = map[string]string{"key": "secret"}
+
+	// a payload that isn't what was signed
+	r = httptest.NewRequest("PUT", "/photos/dog.txt", strings.NewReader("woof"))
+	signTestS3Request(r, []byte("meow"))
+	w = httptest.NewRecorder()
+	serveS3(w, r)
+	if w.Code == 200 {
+		t.Errorf("expected a tampered payload to fail")
+	}
+	if _, err := storage.Lstat("/bucket/photos/dog.txt"); err == nil {
+		t.Errorf("tampered payload was stored")
+	}
+
+	// keys can't climb out of their bucket
+	if w := serveTestS3Request("GET", "/photos/../photos/cat.txt", nil); w.Code == 200 {
+		t.Errorf("expected a key with .. to fail")
+	}
+}
+
+func TestS3PutKeepsLinks(t *testing.T) {
+	storage := useMemoryStorage(t)
+	useTestS3Keys(t)
+	writeTestFile(t, storage, "/bucket/photos/cat.txt", []byte("meow"))
+	if err := storage.Symlink("cat.txt", "/bucket/photos/kitten.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serveTestS3Request("PUT", "/photos/kitten.txt", []byte("purr")); w.Code != 200 {
+		t.Fatalf("putting an object: %d %s", w.Code, w.Body.String())
+	}
+
+	if file, err := storage.Lstat("/bucket/photos/kitten.txt"); err != nil || file.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected the link to stay a link: %v", err)
+	}
+	if data, err := readStorageFile(storage, "/bucket/photos/cat.txt"); err != nil || string(data) != "purr" {
+		t.Errorf("expected the file the link leads to to be replaced: %q %v", data, err)
+	}
+}
+
+func TestS3Folders(t *testing.T) {
+	storage := useMemoryStorage(t)
+	useTestS3Keys(t)
+	writeTestFile(t, storage, "/bucket/photos/cat.txt", []byte("meow"))
+
+	// nothing can be stored under an object, since it isn't a folder
+	w := serveTestS3Request("PUT", "/photos/cat.txt/kitten.txt", []byte("mew"))
+	if w.Code != 409 || !strings.Contains(w.Body.String(), "<Code>InvalidRequest</Code>") {
+		t.Errorf("expected 409 InvalidRequest putting an object under another, got %d %s", w.Code, w.Body.String())
+	}
+	expectTestFile(t, storage, "/bucket/photos/cat.txt", "meow")
+
+	if w := serveTestS3Request("PUT", "/photos/empty/", nil); w.Code != 200 {
+		t.Fatalf("creating a folder: %d %s", w.Code, w.Body.String())
+	}
+	if w := serveTestS3Request("PUT", "/photos/full/dog.txt", []byte("woof")); w.Code != 200 {
+		t.Fatalf("putting an object: %d %s", w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		key     string
+		removed string // the path that should be gone afterwards, if any
+		kept    string // the path that should still be there
+	}{
+		{"empty", "", "/bucket/photos/empty"},      // not the folder's key
+		{"cat.txt/", "", "/bucket/photos/cat.txt"}, // not an object's key
+		{"full/", "", "/bucket/photos/full/dog.txt"},
+		{"empty/", "/bucket/photos/empty", ""},
+	}
+
+	for _, test := range tests {
+		if w := serveTestS3Request("DELETE", "/photos/"+test.key, nil); w.Code != 204 {
+			t.Errorf("%s: expected 204, got %d %s", test.key, w.Code, w.Body.String())
+		}
+		if _, err := storage.Lstat(test.removed); test.removed != "" && err == nil {
+			t.Errorf("%s: expected %s to be removed", test.key, test.removed)
+		}
+		if _, err := storage.Lstat(test.kept); test.kept != "" && err != nil {
+			t.Errorf("%s: expected %s to be kept: %s", test.key, test.kept, err)
+		}
+	}
+}
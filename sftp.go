@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// serves the root over SFTP, confining every path to it using the same rules
+// as the rest of our handlers.
+type rootSFTPHandler struct {
+	deleter string // who to blame for anything deleted
+}
+
+// maps an SFTP path to the real path under the root
+func (rootSFTPHandler) resolve(name string) (string, error) {
+	normalizedPath, err := normalizePathUnderRoot(ROOT, name)
+	if err != nil {
+		return "", sftp.ErrSSHFxNoSuchFile
+	}
+
+	return normalizedPath, nil
+}
+
+// converts a file system error into one that's safe to send to the client,
+// since the raw errors contain full server paths.
+func sftpError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return sftp.ErrSSHFxNoSuchFile
+	case os.IsPermission(err):
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	return sftp.ErrSSHFxFailure
+}
+
+func (h rootSFTPHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	normalizedPath, err := h.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := STORAGE.Open(normalizedPath)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+
+	return f, nil
+}
+
+func (h rootSFTPHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	normalizedPath, err := h.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	// SFTP clients write at arbitrary offsets, which needs a real file
+	filePath, err := localPath(normalizedPath)
+	if err != nil {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+
+	// NOTE: we never open with O_APPEND, since the client writes at explicit
+	// offsets anyway and the two don't mix.
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+
+	// keep whatever we're about to write over
+	if !pflags.Excl {
+		if err := saveVersion(normalizedPath); err != nil {
+			return nil, sftpError(err)
+		}
+	}
+
+	f, err := openRewrittenFile(filePath, flags, 0644)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+
+	return f, nil
+}
+
+func (h rootSFTPHandler) Filecmd(r *sftp.Request) error {
+	// the destination of a link isn't a path we can resolve on its own
+	if r.Method == "Symlink" {
+		return h.symlink(r)
+	}
+
+	normalizedPath, err := h.resolve(r.Filepath)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "Setstat":
+		// storage has no notion of any of these, only the local disk does
+		filePath, err := localPath(normalizedPath)
+		if err != nil {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+
+		attrs := r.Attributes()
+		flags := r.AttrFlags()
+		if flags.Size {
+			// keep the old contents, and change the size on a copy so files
+			// hard linked to this one keep theirs
+			if err := saveVersion(normalizedPath); err != nil {
+				return sftpError(err)
+			}
+			f, err := openRewrittenFile(filePath, os.O_WRONLY, 0)
+			if err != nil {
+				return sftpError(err)
+			}
+			err = f.Truncate(int64(attrs.Size))
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return sftpError(err)
+			}
+		}
+
+		// NOTE: permissions and times belong to the file rather than the name, so
+		// these change every copy dedupe hard linked to this one as well.
+		if flags.Permissions {
+			if err := os.Chmod(filePath, attrs.FileMode().Perm()); err != nil {
+				return sftpError(err)
+			}
+		}
+		if flags.Acmodtime {
+			if err := os.Chtimes(filePath, attrs.AccessTime(), attrs.ModTime()); err != nil {
+				return sftpError(err)
+			}
+		}
+
+		// NOTE: ownership changes are silently ignored, since every file belongs
+		// to whoever runs the server.
+		return nil
+
+	case "Rename":
+		targetPath, err := h.resolve(r.Target)
+		if err != nil {
+			return err
+		}
+
+		// moving the root would take everything else with it
+		if normalizedPath == ROOT || targetPath == ROOT {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+
+		if err := checkMovedSymlink(normalizedPath, targetPath); err != nil {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+
+		// SFTP renames must not replace anything that's already there
+		if _, err := STORAGE.Lstat(targetPath); err == nil {
+			return sftp.ErrSSHFxFailure
+		}
+
+		return sftpError(STORAGE.Rename(normalizedPath, targetPath))
+
+	case "Rmdir", "Remove":
+		// never let anyone delete the root itself
+		if normalizedPath == ROOT {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+
+		file, err := STORAGE.Lstat(normalizedPath)
+		if err != nil {
+			return sftpError(err)
+		}
+		if file.IsDir() != (r.Method == "Rmdir") {
+			return sftp.ErrSSHFxFailure
+		}
+
+		// only empty directories may be removed
+		if file.IsDir() {
+			children, err := STORAGE.ReadDir(normalizedPath)
+			if err != nil {
+				return sftpError(err)
+			} else if len(children) > 0 {
+				return sftp.ErrSSHFxFailure
+			}
+		}
+
+		return sftpError(deletePath(withDeleter(context.Background(), h.deleter), normalizedPath))
+
+	case "Mkdir":
+		return sftpError(STORAGE.Mkdir(normalizedPath))
+
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// creates a symlink. pkg/sftp gives us the link's path in Target and its
+// destination, exactly as the client sent it, in Filepath.
+func (h rootSFTPHandler) symlink(r *sftp.Request) error {
+	linkPath, err := h.resolve(r.Target)
+	if err != nil {
+		return err
+	}
+
+	// clients only see the root, so absolute destinations are relative to it.
+	// the link itself is always made relative, so it keeps working if the root
+	// moves.
+	destPath := filepath.Join(ROOT, r.Filepath)
+	if !filepath.IsAbs(r.Filepath) {
+		destPath = filepath.Join(filepath.Dir(linkPath), r.Filepath)
+	}
+	linkDest, err := filepath.Rel(filepath.Dir(linkPath), destPath)
+	if err != nil {
+		return sftp.ErrSSHFxFailure
+	}
+
+	if err := checkNewSymlink(linkPath, linkDest); err != nil {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	// only the local disk can hold links we make
+	localLinkPath, err := localPath(linkPath)
+	if err != nil {
+		return sftp.ErrSSHFxOpUnsupported
+	}
+
+	return sftpError(os.Symlink(linkDest, localLinkPath))
+}
+
+// a list of files we've already read, handed out to the client a few at a time
+type sftpFileList []os.FileInfo
+
+func (l sftpFileList) ListAt(files []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(files, l[offset:])
+	if n < len(files) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h rootSFTPHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	normalizedPath, err := h.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "List":
+		children, err := STORAGE.ReadDir(normalizedPath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+
+		visible := sftpFileList{}
+		for _, child := range children {
+			if !isReservedName(child.Name()) {
+				visible = append(visible, child)
+			}
+		}
+		return visible, nil
+
+	case "Stat":
+		file, err := STORAGE.Stat(normalizedPath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return sftpFileList{file}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h rootSFTPHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	normalizedPath, err := h.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := STORAGE.Lstat(normalizedPath)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	return sftpFileList{file}, nil
+}
+
+func (h rootSFTPHandler) Readlink(name string) (string, error) {
+	normalizedPath, err := h.resolve(name)
+	if err != nil {
+		return "", err
+	}
+
+	dest, err := STORAGE.Readlink(normalizedPath)
+	return dest, sftpError(err)
+}
+
+// returns the host key stored at the given path, generating and saving a new
+// one if there isn't one yet so clients see the same key across restarts.
+func loadSFTPHostKey(keyPath string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, "bucket SFTP host key")
+	if err != nil {
+		return nil, err
+	}
+
+	// only we should ever be able to read the key
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return nil, err
+	}
+
+	// O_EXCL so we never clobber a key that appeared since we checked
+	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = pem.Encode(f, block)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(keyPath)
+		return nil, err
+	}
+
+	log.Printf("Generated a new SFTP host key in %s", keyPath)
+	return ssh.NewSignerFromKey(key)
+}
+
+// reads the public keys allowed to log in from a file in OpenSSH's
+// authorized_keys format.
+func loadSFTPAuthorizedKeys(keysPath string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(keysPath)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for len(data) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// this is also how we find out there are no more keys
+			break
+		}
+
+		keys[string(key.Marshal())] = true
+		data = rest
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No keys found in %s", keysPath)
+	}
+
+	return keys, nil
+}
+
+// accepts SFTP connections on the given address forever, allowing anyone
+// holding one of the authorized keys to log in.
+//
+// NOTE: the HTTP API has no accounts or per-user permissions to share, so
+// every authorized key gets full access to the whole root, just like anyone
+// who can reach the HTTP API.
+func serveSFTP(addr string, hostKey ssh.Signer, authorizedKeys map[string]bool) error {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if authorizedKeys[string(key.Marshal())] {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, fmt.Errorf("Unknown public key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go handleSFTPConn(conn, config)
+	}
+}
+
+// runs the SSH handshake for a single connection, then serves SFTP over every
+// session the client opens on it.
+func handleSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Printf("SFTP handshake with %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+	defer sshConn.Close()
+
+	log.Printf("SFTP login from %s as %s", sshConn.RemoteAddr(), sshConn.User())
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "Only sessions are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("Failed to accept SFTP session: %s", err)
+			continue
+		}
+
+		go serveSFTPSession(channel, requests, fmt.Sprintf("sftp %s@%s", sshConn.User(), sshConn.RemoteAddr()))
+	}
+}
+
+// waits for the client to ask for the SFTP subsystem, then serves it. nothing
+// else (shells, commands, forwarding) is allowed. deletes are attributed to
+// the given deleter.
+func serveSFTPSession(channel ssh.Channel, requests <-chan *ssh.Request, deleter string) {
+	defer channel.Close()
+
+	for req := range requests {
+		// the payload is the subsystem's name, prefixed with its length
+		isSFTP := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(isSFTP, nil)
+		if !isSFTP {
+			continue
+		}
+
+		go ssh.DiscardRequests(requests)
+
+		handler := rootSFTPHandler{deleter}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{
+			FileGet:  handler,
+			FilePut:  handler,
+			FileCmd:  handler,
+			FileList: handler,
+		})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Printf("SFTP session ended with an error: %s", err)
+		}
+		server.Close()
+		return
+	}
+}
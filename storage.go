@@ -0,0 +1,671 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// where the files we serve live. names are always the full, normalized paths
+// returned by normalizePathUnderRoot, so backends never see anything that
+// could escape the root.
+//
+// NOTE: thumbnails, previews, streams and the like hand files straight to
+// external programs, so those only work with storage that also implements
+// LocalStorage.
+type Storage interface {
+	// returns info about a file, following it if it's a symlink
+	Stat(name string) (os.FileInfo, error)
+
+	// returns info about a file without following symlinks
+	Lstat(name string) (os.FileInfo, error)
+
+	// returns the contents of a directory, sorted by name. symlinks in it are
+	// not followed.
+	ReadDir(name string) ([]os.FileInfo, error)
+
+	// opens a file for reading. files can be read from at any offset, so they
+	// can serve range requests.
+	Open(name string) (StorageFile, error)
+
+	// creates a file for writing, truncating it if it already exists
+	Create(name string) (io.WriteCloser, error)
+
+	// creates a directory, failing if it already exists
+	Mkdir(name string) error
+
+	// creates a directory, along with any missing parents
+	MkdirAll(name string) error
+
+	// removes a file or empty directory
+	Remove(name string) error
+
+	// moves a file or directory, replacing any file already at the new name
+	Rename(oldName string, newName string) error
+
+	// returns the destination of a symlink
+	Readlink(name string) (string, error)
+}
+
+// a file opened for reading from storage
+type StorageFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// storage that keeps its files on the local disk, where anything that needs a
+// real file (external programs, random writes, hard links and the like) can
+// get at them.
+type LocalStorage interface {
+	Storage
+
+	// returns where a file is on the local disk
+	LocalPath(name string) string
+}
+
+// the storage every handler works with
+var STORAGE Storage = localStorage{}
+
+// every temporary file we create in the served tree has a name starting with
+// this, so anything syncing the tree knows to leave them alone.
+const tempNamePrefix = ".bucket-"
+
+// returns a name for a new temporary file in the given directory. the kind
+// only makes it easier to tell where a stray one came from.
+func tempPathIn(dir string, kind string) string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return filepath.Join(dir, tempNamePrefix+kind+"-"+hex.EncodeToString(id))
+}
+
+// returns where a file in STORAGE is on the local disk, or an error if the
+// storage doesn't keep its files there.
+func localPath(name string) (string, error) {
+	local, ok := STORAGE.(LocalStorage)
+	if !ok {
+		return "", fmt.Errorf("Not supported by this storage")
+	}
+	return local.LocalPath(name), nil
+}
+
+// returns the name a new version of a file should be moved to. if the file is
+// a link that's whatever the link leads to, so replacing the file keeps it.
+func replacedPath(name string) string {
+	if file, err := STORAGE.Lstat(name); err == nil && file.Mode()&os.ModeSymlink != 0 {
+		if resolved, err := evalStorageSymlinks(STORAGE, name); err == nil {
+			return resolved
+		}
+	}
+	return name
+}
+
+// gives a new version of a file the permissions of the one it replaces.
+// permissions can only be kept on the local disk, so elsewhere this does
+// nothing.
+func keepPermissions(tempPath string, file os.FileInfo) error {
+	localTemp, err := localPath(tempPath)
+	if err != nil {
+		return nil
+	}
+	return os.Chmod(localTemp, file.Mode().Perm())
+}
+
+// returns the contents of a file in storage
+func readStorageFile(storage Storage, name string) ([]byte, error) {
+	f, err := storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// replaces the contents of a file in storage
+func writeStorageFile(storage Storage, name string, data []byte) error {
+	f, err := storage.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// removes a file or directory along with everything in it, much like
+// os.RemoveAll but for any storage. names that don't exist are ignored.
+func removeAllStorage(storage Storage, name string) error {
+	file, err := storage.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if file.IsDir() {
+		children, err := storage.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := removeAllStorage(storage, path.Join(name, child.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return storage.Remove(name)
+}
+
+// returns the name a path leads to once every symlink in it has been followed,
+// much like filepath.EvalSymlinks but for any storage.
+func evalStorageSymlinks(storage Storage, name string) (string, error) {
+	resolved := ""
+	if path.IsAbs(name) {
+		resolved = "/"
+	}
+
+	remaining := strings.Split(name, "/")
+	for links := 0; len(remaining) > 0; {
+		part := remaining[0]
+		remaining = remaining[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Join(resolved, "..")
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		file, err := storage.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if file.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		// give up on link loops the same way the OS does
+		links++
+		if links > 40 {
+			return "", &os.PathError{Op: "lstat", Path: name, Err: fmt.Errorf("Too many levels of symbolic links")}
+		}
+
+		dest, err := storage.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(dest) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(dest, "/"), remaining...)
+	}
+
+	if resolved == "" {
+		return ".", nil
+	}
+	return resolved, nil
+}
+
+// calls the given function for the root and everything under it, much like
+// filepath.Walk but for any storage.
+func walkStorage(storage Storage, root string, fn filepath.WalkFunc) error {
+	file, err := storage.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkStorageFile(storage, root, file, fn)
+	}
+
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkStorageFile(storage Storage, name string, file os.FileInfo, fn filepath.WalkFunc) error {
+	if !file.IsDir() {
+		return fn(name, file, nil)
+	}
+
+	children, err := storage.ReadDir(name)
+	err1 := fn(name, file, err)
+
+	// give the function a chance to skip the directory even if reading it failed
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, child := range children {
+		err := walkStorageFile(storage, path.Join(name, child.Name()), child, fn)
+		if err != nil && (!child.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storage backed by the local file system. this is the default.
+type localStorage struct{}
+
+func (localStorage) Stat(name string) (os.FileInfo, error)  { return os.Stat(name) }
+func (localStorage) Lstat(name string) (os.FileInfo, error) { return os.Lstat(name) }
+func (localStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (localStorage) Open(name string) (StorageFile, error) {
+	// returning the *os.File directly would make a nil file a non-nil interface
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (localStorage) Create(name string) (io.WriteCloser, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (localStorage) Mkdir(name string) error                     { return os.Mkdir(name, 0755) }
+func (localStorage) MkdirAll(name string) error                  { return os.MkdirAll(name, 0755) }
+func (localStorage) Remove(name string) error                    { return os.Remove(name) }
+func (localStorage) Rename(oldName string, newName string) error { return os.Rename(oldName, newName) }
+func (localStorage) Readlink(name string) (string, error)        { return os.Readlink(name) }
+func (localStorage) LocalPath(name string) string                { return name }
+
+// storage held entirely in memory, mostly useful for exercising handlers
+// without touching the disk.
+type memoryStorage struct {
+	sync.RWMutex
+	files map[string]*memoryFile
+}
+
+// a file, directory or symlink in memory storage
+type memoryFile struct {
+	mode     os.FileMode
+	modTime  time.Time
+	data     []byte
+	linkDest string
+}
+
+// describes a file in memory storage
+type memoryFileInfo struct {
+	name string
+	file memoryFile
+}
+
+func (f memoryFileInfo) Name() string       { return f.name }
+func (f memoryFileInfo) Size() int64        { return int64(len(f.file.data)) }
+func (f memoryFileInfo) Mode() os.FileMode  { return f.file.mode }
+func (f memoryFileInfo) ModTime() time.Time { return f.file.modTime }
+func (f memoryFileInfo) IsDir() bool        { return f.file.mode.IsDir() }
+func (f memoryFileInfo) Sys() interface{}   { return nil }
+
+// returns empty memory storage containing only the given root directory, and
+// the ones leading to it
+func newMemoryStorage(root string) *memoryStorage {
+	files := map[string]*memoryFile{}
+	for dir := path.Clean(root); ; dir = path.Dir(dir) {
+		files[dir] = &memoryFile{mode: os.ModeDir | 0755, modTime: time.Now()}
+		if dir == path.Dir(dir) {
+			break
+		}
+	}
+
+	return &memoryStorage{files: files}
+}
+
+// follows any symlinks at the given name, including any in the directories
+// leading to it, returning where they end up. the caller must hold the lock.
+func (s *memoryStorage) resolve(name string) (string, *memoryFile, error) {
+	resolved := "/"
+	if !path.IsAbs(name) {
+		resolved = "."
+	}
+
+	// give up on link loops the same way the OS does
+	links := 0
+	pending := strings.Split(path.Clean(name), "/")
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		currentName := path.Join(resolved, part)
+		file, ok := s.files[currentName]
+		if !ok {
+			return "", nil, os.ErrNotExist
+		}
+		if file.mode&os.ModeSymlink == 0 {
+			resolved = currentName
+			continue
+		}
+
+		links++
+		if links > 40 {
+			return "", nil, fmt.Errorf("Too many levels of symbolic links")
+		}
+
+		// carry on from wherever the link leads
+		if path.IsAbs(file.linkDest) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(file.linkDest, "/"), pending...)
+	}
+
+	file, ok := s.files[resolved]
+	if !ok {
+		return "", nil, os.ErrNotExist
+	}
+	return resolved, file, nil
+}
+
+// returns the real name of the given name, following links in the directories
+// leading to it but not one at the name itself. returns an error if the parent
+// directory doesn't exist. the caller must hold the lock.
+func (s *memoryStorage) locate(name string) (string, error) {
+	name = path.Clean(name)
+
+	parentName, parent, err := s.resolve(path.Dir(name))
+	if err != nil {
+		return "", err
+	} else if !parent.mode.IsDir() {
+		return "", fmt.Errorf("Not a directory")
+	}
+
+	return path.Join(parentName, path.Base(name)), nil
+}
+
+func (s *memoryStorage) Stat(name string) (os.FileInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	_, file, err := s.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return memoryFileInfo{path.Base(name), *file}, nil
+}
+
+func (s *memoryStorage) Lstat(name string) (os.FileInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	realName, err := s.locate(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+
+	file, ok := s.files[realName]
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	}
+	return memoryFileInfo{path.Base(name), *file}, nil
+}
+
+func (s *memoryStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	dirName, dir, err := s.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !dir.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: fmt.Errorf("Not a directory")}
+	}
+
+	children := []os.FileInfo{}
+	for childName, child := range s.files {
+		if childName != dirName && path.Dir(childName) == dirName {
+			children = append(children, memoryFileInfo{path.Base(childName), *child})
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+
+	return children, nil
+}
+
+// a file opened for reading from memory storage
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error { return nil }
+
+func (s *memoryStorage) Open(name string) (StorageFile, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	_, file, err := s.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if file.mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("Is a directory")}
+	}
+
+	// files are never modified in place, so it's safe to read this one after
+	// we've let go of the lock.
+	return memoryReader{bytes.NewReader(file.data)}, nil
+}
+
+// a file being written to memory storage. the contents only show up once it's
+// closed.
+type memoryWriter struct {
+	bytes.Buffer
+	storage *memoryStorage
+	name    string
+}
+
+func (w *memoryWriter) Close() error {
+	w.storage.Lock()
+	defer w.storage.Unlock()
+
+	if _, err := w.storage.locate(w.name); err != nil {
+		return &os.PathError{Op: "close", Path: w.name, Err: err}
+	}
+
+	w.storage.files[w.name] = &memoryFile{mode: 0644, modTime: time.Now(), data: w.Bytes()}
+	return nil
+}
+
+func (s *memoryStorage) Create(name string) (io.WriteCloser, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	// writing through a link replaces whatever it leads to
+	realName, _, err := s.resolve(name)
+	if err != nil {
+		if realName, err = s.locate(name); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	if file, ok := s.files[realName]; ok && file.mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("Is a directory")}
+	}
+
+	return &memoryWriter{storage: s, name: realName}, nil
+}
+
+func (s *memoryStorage) Mkdir(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	realName, err := s.locate(name)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	if _, ok := s.files[realName]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+
+	s.files[realName] = &memoryFile{mode: os.ModeDir | 0755, modTime: time.Now()}
+	return nil
+}
+
+func (s *memoryStorage) MkdirAll(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// find the deepest directory that already exists
+	var missing []string
+	existingName := ""
+	for dir := path.Clean(name); ; dir = path.Dir(dir) {
+		if realName, file, err := s.resolve(dir); err == nil {
+			if !file.mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: fmt.Errorf("Not a directory")}
+			}
+			existingName = realName
+			break
+		}
+
+		if dir == path.Dir(dir) {
+			existingName = dir
+			missing = append(missing, "")
+			break
+		}
+		missing = append(missing, path.Base(dir))
+	}
+
+	// then create every missing one below it from the top down
+	for i := len(missing) - 1; i >= 0; i-- {
+		existingName = path.Join(existingName, missing[i])
+		s.files[existingName] = &memoryFile{mode: os.ModeDir | 0755, modTime: time.Now()}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) Remove(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	realName, err := s.locate(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	file, ok := s.files[realName]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+
+	if file.mode.IsDir() {
+		for childName := range s.files {
+			if childName != realName && path.Dir(childName) == realName {
+				return &os.PathError{Op: "remove", Path: name, Err: fmt.Errorf("Directory not empty")}
+			}
+		}
+	}
+
+	delete(s.files, realName)
+	return nil
+}
+
+func (s *memoryStorage) Rename(oldName string, newName string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	realOldName, err := s.locate(oldName)
+	if err != nil {
+		return &os.PathError{Op: "rename", Path: oldName, Err: err}
+	}
+	file, ok := s.files[realOldName]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrNotExist}
+	}
+
+	realNewName, err := s.locate(newName)
+	if err != nil {
+		return &os.PathError{Op: "rename", Path: newName, Err: err}
+	}
+	oldName, newName = realOldName, realNewName
+	if existing, ok := s.files[newName]; ok && existing.mode.IsDir() {
+		return &os.PathError{Op: "rename", Path: newName, Err: fmt.Errorf("File exists")}
+	}
+	if newName == oldName {
+		return nil
+	}
+	if strings.HasPrefix(newName, oldName+"/") {
+		return &os.PathError{Op: "rename", Path: newName, Err: fmt.Errorf("Invalid argument")}
+	}
+
+	// move everything under a directory along with it
+	for childName, child := range s.files {
+		if strings.HasPrefix(childName, oldName+"/") {
+			delete(s.files, childName)
+			s.files[newName+strings.TrimPrefix(childName, oldName)] = child
+		}
+	}
+
+	delete(s.files, oldName)
+	s.files[newName] = file
+	return nil
+}
+
+func (s *memoryStorage) Readlink(name string) (string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	realName, err := s.locate(name)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	file, ok := s.files[realName]
+	if !ok || file.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: fmt.Errorf("Invalid argument")}
+	}
+
+	return file.linkDest, nil
+}
+
+// creates a symlink in memory storage. this isn't part of the storage
+// interface since nothing serves requests by creating links.
+func (s *memoryStorage) Symlink(linkDest string, name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	realName, err := s.locate(name)
+	if err != nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: err}
+	}
+	if _, ok := s.files[realName]; ok {
+		return &os.PathError{Op: "symlink", Path: name, Err: fmt.Errorf("File exists")}
+	}
+
+	s.files[realName] = &memoryFile{mode: os.ModeSymlink | 0777, modTime: time.Now(), linkDest: linkDest}
+	return nil
+}
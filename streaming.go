@@ -0,0 +1,455 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	hlsSegmentDuration    = 6                // length of each segment in seconds
+	hlsSegmentWaitTimeout = 60 * time.Second // how long to wait for a segment to be transcoded
+	hlsSeekThreshold      = 3                // segments ahead of the transcoder before we restart it
+	hlsIdleTimeout        = 5 * time.Minute  // how long a transcode can go unused before we clean it up
+	hlsEvictTimeout       = 30 * time.Second // how long a transcode must be unused before another can replace it
+)
+
+// a single rung of the quality ladder we offer for streamed video
+type hlsQuality struct {
+	Name         string
+	Height       int
+	VideoBitrate int // in kilobits per second
+	AudioBitrate int // in kilobits per second
+}
+
+// every quality we can transcode to, from worst to best
+var hlsQualities = []hlsQuality{
+	{"360p", 360, 800, 96},
+	{"480p", 480, 1400, 128},
+	{"720p", 720, 2800, 128},
+	{"1080p", 1080, 5000, 192},
+}
+
+// the maximum number of transcodes we'll run at once
+var MAX_TRANSCODES = 2
+
+// a running (or finished) ffmpeg process generating HLS segments for a single
+// version of a file at a single quality.
+type hlsTranscode struct {
+	dir        string        // where the segments are written
+	start      int           // the first segment this process produces
+	cmd        *exec.Cmd     // the ffmpeg process
+	exited     chan struct{} // closed once the process exits
+	lastAccess time.Time     // when a segment was last requested
+}
+
+// returns whether the transcode's process has exited
+func (t *hlsTranscode) hasExited() bool {
+	select {
+	case <-t.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// kills the transcode's process if it's still running, without waiting for it
+// to exit.
+func (t *hlsTranscode) kill() {
+	if !t.hasExited() {
+		t.cmd.Process.Kill()
+	}
+}
+
+// kills the transcode's process (if it's still running) and waits for it to
+// exit.
+func (t *hlsTranscode) stop() {
+	t.kill()
+	<-t.exited
+}
+
+// all the transcodes we know about, keyed by cache key
+var hlsTranscodes = struct {
+	sync.Mutex
+	m map[string]*hlsTranscode
+}{m: map[string]*hlsTranscode{}}
+
+// stops a transcode that has already been taken out of the map above, then
+// removes its segments unless a new transcode has started writing to the same
+// directory in the meantime.
+func retireHLSTranscode(key string, t *hlsTranscode) {
+	t.stop()
+
+	hlsTranscodes.Lock()
+	defer hlsTranscodes.Unlock()
+	if _, exists := hlsTranscodes.m[key]; !exists {
+		os.RemoveAll(t.dir)
+	}
+}
+
+// returns the quality with the given name, if there is one
+func getHLSQuality(name string) (hlsQuality, bool) {
+	for _, quality := range hlsQualities {
+		if quality.Name == name {
+			return quality, true
+		}
+	}
+
+	return hlsQuality{}, false
+}
+
+// returns the path to the given segment within a transcode's directory
+func hlsSegmentPath(dir string, segment int) string {
+	return filepath.Join(dir, strconv.Itoa(segment)+".ts")
+}
+
+// starts an ffmpeg process that transcodes the file to HLS segments at the
+// given quality, beginning at the given segment. the caller must hold the
+// transcodes lock.
+func startHLSTranscode(filePath string, dir string, quality hlsQuality, start int) (*hlsTranscode, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(
+		"ffmpeg",
+
+		// only complain if something actually goes wrong
+		"-v", "error",
+
+		// jump straight to the segment we want. doing this before the input
+		// makes ffmpeg seek using the container's index, which is much faster.
+		"-ss", strconv.Itoa(start*hlsSegmentDuration),
+
+		// the file we're processing
+		"-i", filePath,
+
+		// keep timestamps continuous with the segments before the one we seeked
+		// to, otherwise players get confused when switching between them.
+		"-output_ts_offset", strconv.Itoa(start*hlsSegmentDuration),
+
+		// scale to the quality's height, keeping the width even (which H.264
+		// requires) and preserving the aspect ratio.
+		"-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", quality.Height),
+
+		// H.264 and AAC are playable pretty much everywhere
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-b:v", fmt.Sprintf("%dk", quality.VideoBitrate),
+		"-maxrate", fmt.Sprintf("%dk", quality.VideoBitrate),
+		"-bufsize", fmt.Sprintf("%dk", 2*quality.VideoBitrate),
+		"-c:a", "aac",
+		"-b:a", fmt.Sprintf("%dk", quality.AudioBitrate),
+		"-ac", "2",
+
+		// put a keyframe at the start of every segment so the segments line up
+		// exactly with the playlist we generate ourselves.
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentDuration),
+
+		// write numbered segments, only moving each into place once it's complete
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentDuration),
+		"-hls_list_size", "0",
+		"-hls_flags", "temp_file+independent_segments",
+		"-start_number", strconv.Itoa(start),
+		"-hls_segment_filename", filepath.Join(dir, "%d.ts"),
+		filepath.Join(dir, "ffmpeg.m3u8"),
+	)
+
+	transcode := &hlsTranscode{
+		dir:        dir,
+		start:      start,
+		cmd:        cmd,
+		exited:     make(chan struct{}),
+		lastAccess: time.Now(),
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("Transcode of %s stopped: %s", filePath, err)
+		}
+		close(transcode.exited)
+	}()
+
+	return transcode, nil
+}
+
+// returns a transcode that will produce the given segment, starting a new one
+// (or restarting an existing one closer to the segment) if necessary. returns
+// an error if there are already too many transcodes running.
+func getHLSTranscode(filePath string, key string, quality hlsQuality, segment int) (*hlsTranscode, error) {
+	// stopping a transcode waits for ffmpeg to exit, so any we replace are only
+	// stopped once we've let go of the lock, rather than holding up every other
+	// request meanwhile.
+	var stale, evicted *hlsTranscode
+	evictedKey := ""
+	defer func() {
+		if stale != nil {
+			stale.stop()
+		}
+		if evicted != nil {
+			retireHLSTranscode(evictedKey, evicted)
+		}
+	}()
+
+	hlsTranscodes.Lock()
+	defer hlsTranscodes.Unlock()
+
+	transcode, exists := hlsTranscodes.m[key]
+	if exists {
+		transcode.lastAccess = time.Now()
+
+		// if the segment has already been generated, we're done
+		if _, err := os.Stat(hlsSegmentPath(transcode.dir, segment)); err == nil {
+			return transcode, nil
+		}
+
+		// figure out how far along the transcode is so we can tell whether it'll
+		// get to the segment any time soon.
+		produced := transcode.start
+		for {
+			if _, err := os.Stat(hlsSegmentPath(transcode.dir, produced)); err != nil {
+				break
+			}
+			produced++
+		}
+
+		// keep using it if the segment is coming up shortly
+		if !transcode.hasExited() && segment >= transcode.start && segment <= produced+hlsSeekThreshold {
+			return transcode, nil
+		}
+
+		// otherwise, the client seeked somewhere we won't get to for a while, so
+		// start over from where they want to be. the new transcode writes to the
+		// same directory, so make sure this one stops writing to it right away.
+		transcode.kill()
+		stale = transcode
+		delete(hlsTranscodes.m, key)
+	} else {
+		// make room for the new transcode if we can, but never interrupt one
+		// that somebody's still watching.
+		running := 0
+		var idlest *hlsTranscode
+		idlestKey := ""
+		for k, t := range hlsTranscodes.m {
+			if t.hasExited() {
+				continue
+			}
+
+			running++
+			if idlest == nil || t.lastAccess.Before(idlest.lastAccess) {
+				idlest = t
+				idlestKey = k
+			}
+		}
+
+		if running >= MAX_TRANSCODES {
+			if idlest == nil || time.Since(idlest.lastAccess) < hlsEvictTimeout {
+				return nil, fmt.Errorf("Too many transcodes running")
+			}
+
+			evicted = idlest
+			evictedKey = idlestKey
+			delete(hlsTranscodes.m, idlestKey)
+		}
+	}
+
+	transcode, err := startHLSTranscode(filePath, cachePath(key), quality, segment)
+	if err != nil {
+		return nil, err
+	}
+
+	hlsTranscodes.m[key] = transcode
+	return transcode, nil
+}
+
+// waits for the given segment to be written, returning its path once it has
+// been, or an error if the transcode stops or we time out.
+func waitForHLSSegment(transcode *hlsTranscode, segment int) (string, error) {
+	segmentPath := hlsSegmentPath(transcode.dir, segment)
+	deadline := time.Now().Add(hlsSegmentWaitTimeout)
+
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(segmentPath); err == nil {
+			return segmentPath, nil
+		}
+
+		// check for the segment one last time in case it was written right before
+		// the process exited.
+		if transcode.hasExited() {
+			if _, err := os.Stat(segmentPath); err == nil {
+				return segmentPath, nil
+			}
+			return "", fmt.Errorf("Transcode stopped before segment %d", segment)
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	return "", fmt.Errorf("Timed out waiting for segment %d", segment)
+}
+
+// periodically stops transcodes nobody is watching any more and removes their
+// segments.
+func cleanupHLSTranscodes() {
+	for range time.Tick(time.Minute) {
+		stale := map[string]*hlsTranscode{}
+		hlsTranscodes.Lock()
+		for key, transcode := range hlsTranscodes.m {
+			if time.Since(transcode.lastAccess) > hlsIdleTimeout {
+				stale[key] = transcode
+				delete(hlsTranscodes.m, key)
+			}
+		}
+		hlsTranscodes.Unlock()
+
+		for key, transcode := range stale {
+			retireHLSTranscode(key, transcode)
+		}
+	}
+}
+
+// streams a video using HTTP Live Streaming. with no query parameters, returns
+// a master playlist listing every quality we offer for the video. with a
+// `quality` parameter, returns the playlist of segments for that quality, and
+// with both `quality` and `segment` parameters returns that segment, which is
+// transcoded on demand.
+func getStream(w http.ResponseWriter, r *http.Request) {
+	rawPath := mux.Vars(r)["path"]
+	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// ensure the file exists
+	file, err := STORAGE.Stat(normalizedPath)
+	if err != nil || file.IsDir() {
+		// don't report the raw error in case we leak server directory information
+		http.Error(w, "Could not find "+rawPath, 404)
+		return
+	}
+
+	mimeType := getMIMEType(normalizedPath)
+	if strings.Index(mimeType, "video") != 0 {
+		// HTTP 415 - Unsupported Media Type
+		http.Error(w, "Unsupported file type: "+mimeType, 415)
+		return
+	}
+
+	// the file has to be on the local disk for ffmpeg to read it
+	filePath, err := localPath(normalizedPath)
+	if err != nil {
+		// HTTP 501 - Not Implemented
+		http.Error(w, err.Error(), 501)
+		return
+	}
+
+	duration, err := getVideoDuration(filePath, file)
+	if err != nil {
+		http.Error(w, "Error reading video", 500)
+		return
+	}
+	segments := int(math.Ceil(duration / hlsSegmentDuration))
+
+	// playlist and segment URIs are relative to the video's own URL
+	baseName := url.PathEscape(path.Base(normalizedPath))
+
+	query := r.URL.Query()
+	rawQuality := query.Get("quality")
+	rawSegment := query.Get("segment")
+
+	// the master playlist, listing each quality that isn't larger than the video
+	// itself (there's no point in upscaling).
+	if rawQuality == "" {
+		metadata := MetadataJSON{}
+		if err := readProbeMetadata(filePath, &metadata); err != nil {
+			http.Error(w, "Error reading video", 500)
+			return
+		}
+
+		playlist := "#EXTM3U\n#EXT-X-VERSION:3\n"
+		for i, quality := range hlsQualities {
+			if i > 0 && quality.Height > metadata.Height {
+				break
+			}
+
+			playlist += fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,NAME=\"%s\"\n%s?quality=%s\n",
+				1000*(quality.VideoBitrate+quality.AudioBitrate),
+				quality.Name,
+				baseName, quality.Name)
+		}
+
+		w.Header().Add("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Add("Cache-Control", "no-cache")
+		w.Write([]byte(playlist))
+		return
+	}
+
+	quality, ok := getHLSQuality(rawQuality)
+	if !ok {
+		http.Error(w, "Unsupported quality: "+rawQuality, 400)
+		return
+	}
+
+	// the playlist for a single quality. since we know the duration and force
+	// keyframes at fixed intervals, we can list every segment up front without
+	// waiting for any of them to be generated.
+	if rawSegment == "" {
+		playlist := fmt.Sprintf(
+			"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-INDEPENDENT-SEGMENTS\n",
+			hlsSegmentDuration,
+		)
+		for i := 0; i < segments; i++ {
+			length := math.Min(hlsSegmentDuration, duration-float64(i*hlsSegmentDuration))
+			playlist += fmt.Sprintf("#EXTINF:%.3f,\n%s?quality=%s&segment=%d\n",
+				length, baseName, quality.Name, i)
+		}
+		playlist += "#EXT-X-ENDLIST\n"
+
+		w.Header().Add("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Add("Cache-Control", "no-cache")
+		w.Write([]byte(playlist))
+		return
+	}
+
+	segment, err := strconv.Atoi(rawSegment)
+	if err != nil || segment < 0 || segment >= segments {
+		http.Error(w, "Invalid segment: "+rawSegment, 400)
+		return
+	}
+
+	key := cacheKey(normalizedPath, file, "hls", quality.Name)
+	transcode, err := getHLSTranscode(filePath, key, quality, segment)
+	if err != nil {
+		// HTTP 503 - Service Unavailable
+		w.Header().Add("Retry-After", "10")
+		http.Error(w, err.Error(), 503)
+		return
+	}
+
+	segmentPath, err := waitForHLSSegment(transcode, segment)
+	if err != nil {
+		http.Error(w, "Error transcoding video", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "video/mp2t")
+	http.ServeFile(w, r, segmentPath)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// how symlinks under the root are treated
+const (
+	symlinksRoot  = "root"  // follow links, but only to things inside the root
+	symlinksAny   = "any"   // follow links wherever they lead
+	symlinksNever = "never" // never follow links at all
+)
+
+var SYMLINK_POLICY = symlinksRoot
+
+// checks every symlink on the way to a path under the root against the
+// symlink policy, returning an error if getting there means following a link
+// we shouldn't. this has to look at the file system, since a path that looks
+// fine can still lead anywhere through a link.
+//
+// NOTE: a link at the end of the path is checked too, even though some uses
+// (deleting it, say) wouldn't follow it. links that can't be followed can't
+// be touched at all.
+func checkSymlinks(fullPath string) error {
+	if SYMLINK_POLICY == symlinksAny {
+		return nil
+	}
+
+	relPath, err := filepath.Rel(ROOT, fullPath)
+	if err != nil || relPathEscapes(relPath) {
+		return fmt.Errorf("Invalid path")
+	} else if relPath == "." {
+		return nil
+	}
+
+	parts := strings.Split(relPath, string(filepath.Separator))
+	currentPath := ROOT
+	for i, part := range parts {
+		currentPath = filepath.Join(currentPath, part)
+
+		file, err := STORAGE.Lstat(currentPath)
+		if err != nil {
+			// nothing below something that doesn't exist can be a link
+			return nil
+		}
+		if file.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if SYMLINK_POLICY == symlinksNever {
+			return fmt.Errorf("Invalid path")
+		}
+
+		// a broken link can't be passed through, but anything created at it
+		// ends up wherever it leads, so that has to be under the root too.
+		if _, err := STORAGE.Stat(currentPath); err != nil && i == len(parts)-1 {
+			if !brokenLinkUnderRoot(currentPath) {
+				return fmt.Errorf("Invalid path")
+			}
+			return nil
+		}
+
+		if !resolvesUnderRoot(currentPath) {
+			return fmt.Errorf("Invalid path")
+		}
+	}
+
+	return nil
+}
+
+// returns whether a path relative to the root leads outside of it
+func relPathEscapes(relPath string) bool {
+	return relPath == ".." || strings.HasPrefix(relPath, "../") || filepath.IsAbs(relPath)
+}
+
+// returns whether the given path, once every symlink in it is followed, is
+// still somewhere under the root. this stops extraction from writing through
+// links that point elsewhere.
+func resolvesUnderRoot(fullPath string) bool {
+	resolvedRoot, err := evalStorageSymlinks(STORAGE, ROOT)
+	if err != nil {
+		return false
+	}
+
+	resolvedPath, err := evalStorageSymlinks(STORAGE, fullPath)
+	if err != nil {
+		return false
+	}
+
+	relPath, err := filepath.Rel(resolvedRoot, resolvedPath)
+	return err == nil && !relPathEscapes(relPath)
+}
+
+// returns whether a symlink that leads nowhere (yet) leads somewhere under the
+// root, following it through any other broken links it leads to. a link whose
+// target's directory doesn't exist can't have anything created through it, so
+// it's as harmless as one leading under the root.
+func brokenLinkUnderRoot(linkPath string) bool {
+	resolvedRoot, err := evalStorageSymlinks(STORAGE, ROOT)
+	if err != nil {
+		return false
+	}
+
+	// give up on link loops the same way the OS does
+	for links := 0; links < 40; links++ {
+		linkDir, err := evalStorageSymlinks(STORAGE, filepath.Dir(linkPath))
+		if err != nil {
+			return false
+		}
+		linkDest, err := STORAGE.Readlink(linkPath)
+		if err != nil {
+			return false
+		}
+
+		// NOTE: this is deliberately not cleaned, so any `..` in it is followed
+		// from wherever the links before it lead, just as the OS would.
+		if !filepath.IsAbs(linkDest) {
+			linkDest = linkDir + "/" + linkDest
+		}
+
+		dir, name := path.Split(strings.TrimRight(linkDest, "/"))
+		if name == "" || name == "." || name == ".." {
+			// nothing can be created at a name like that
+			return true
+		}
+		resolvedDir, err := evalStorageSymlinks(STORAGE, dir)
+		if err != nil {
+			return true
+		}
+		target := path.Join(resolvedDir, name)
+
+		relPath, err := filepath.Rel(resolvedRoot, target)
+		if err != nil || relPathEscapes(relPath) {
+			return false
+		}
+
+		// creating something at another broken link goes wherever that leads
+		file, err := STORAGE.Lstat(target)
+		if err != nil || file.Mode()&os.ModeSymlink == 0 {
+			return true
+		}
+		linkPath = target
+	}
+
+	return false
+}
+
+// returns where a symlink under the root leads, and whether the symlink
+// policy lets us follow it. targets inside the root are given relative to it
+// so we don't reveal where the root is. targets outside it are only given if
+// we'd follow them anyway.
+func describeLink(fullPath string) (string, bool) {
+	resolvedPath, err := evalStorageSymlinks(STORAGE, fullPath)
+	if err != nil {
+		return "", false
+	}
+
+	if realRoot, err := evalStorageSymlinks(STORAGE, ROOT); err == nil {
+		relPath, err := filepath.Rel(realRoot, resolvedPath)
+		if err == nil && !relPathEscapes(relPath) {
+			if relPath == "." {
+				relPath = ""
+			}
+			return "/" + filepath.ToSlash(relPath), SYMLINK_POLICY != symlinksNever
+		}
+	}
+
+	if SYMLINK_POLICY == symlinksAny {
+		return resolvedPath, true
+	}
+	return "", false
+}
+
+// returns an error if we shouldn't make a symlink at linkPath leading to
+// linkDest. links can't be made at all if they'd never be followed, and
+// otherwise only relative ones leading inside the root can be, so they keep
+// working if the root moves.
+func checkNewSymlink(linkPath string, linkDest string) error {
+	if SYMLINK_POLICY == symlinksNever {
+		return fmt.Errorf("Symlinks are disabled")
+	}
+
+	if filepath.IsAbs(linkDest) {
+		return fmt.Errorf("Invalid path")
+	}
+
+	relPath, err := filepath.Rel(ROOT, filepath.Join(filepath.Dir(linkPath), linkDest))
+	if err != nil || relPathEscapes(relPath) {
+		return fmt.Errorf("Invalid path")
+	}
+	return nil
+}
+
+// returns an error if moving whatever is at oldPath to newPath would leave a
+// symlink the policy doesn't allow. a relative link leads somewhere else once
+// it's moved, so moving one is as good as making a new one.
+func checkMovedSymlink(oldPath string, newPath string) error {
+	if SYMLINK_POLICY == symlinksAny {
+		return nil
+	}
+
+	file, err := STORAGE.Lstat(oldPath)
+	if err != nil || file.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	if SYMLINK_POLICY == symlinksNever {
+		return fmt.Errorf("Symlinks are disabled")
+	}
+
+	linkDest, err := STORAGE.Readlink(oldPath)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(linkDest) {
+		linkDest = filepath.Join(filepath.Dir(newPath), linkDest)
+	}
+
+	relPath, err := filepath.Rel(ROOT, linkDest)
+	if err != nil || relPathEscapes(relPath) {
+		return fmt.Errorf("Invalid path")
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// the file in the local directory where two-way sync remembers what both
+// sides looked like the last time they agreed.
+const syncStateName = ".bucket-sync.json"
+
+// how long to wait for local changes to settle before syncing them
+const syncSettleDelay = time.Second
+
+// what both sides of a path looked like the last time they were in sync.
+// versions are opaque strings that change whenever the file does, and are
+// empty for files that don't exist.
+type syncEntry struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+type syncState struct {
+	Remote  string               `json:"remote"` // what the local directory syncs with
+	Entries map[string]syncEntry `json:"entries"`
+}
+
+// returns whether a name belongs to one of the temporary files we and the
+// server create while transferring things, which should never be synced
+// themselves.
+func syncIgnored(name string) bool {
+	return strings.HasPrefix(name, tempNamePrefix)
+}
+
+// returns the version of a local file
+func localSyncVersion(file os.FileInfo) string {
+	if file.IsDir() {
+		return "dir"
+	}
+	return fmt.Sprintf("%d:%d", file.Size(), file.ModTime().UnixNano())
+}
+
+// returns the version of a file on the server
+func remoteSyncVersion(file FileInfoJSON) string {
+	if file.IsDirectory {
+		return "dir"
+	}
+
+	// servers too old to give a version still give the size and time, which
+	// is coarser but at least never empty, since that would mean it's gone
+	if file.Version == "" {
+		return fmt.Sprintf("%d:%s", file.Size, file.ModifiedAt)
+	}
+	return file.Version
+}
+
+// keeps a local directory and a directory on the server in sync in both
+// directions, for as long as it runs.
+type twoWaySync struct {
+	c          *client
+	localRoot  string
+	remoteRoot string
+	state      syncState
+	watcher    *fsnotify.Watcher
+}
+
+// loads the sync state from the local directory, starting afresh if there is
+// none or it belongs to a different server directory.
+func (s *twoWaySync) loadState() {
+	remote := s.c.server + "/" + strings.Trim(s.remoteRoot, "/")
+	s.state = syncState{remote, map[string]syncEntry{}}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.localRoot, syncStateName))
+	if err != nil {
+		return
+	}
+
+	var state syncState
+	if err := json.Unmarshal(data, &state); err != nil || state.Remote != remote || state.Entries == nil {
+		log.Printf("Ignoring sync state for another directory")
+		return
+	}
+	s.state = state
+}
+
+// saves the sync state so a restart can pick up where we left off
+func (s *twoWaySync) saveState() error {
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(s.localRoot, ".bucket-sync")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(s.localRoot, syncStateName))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// returns everything under the local directory by relative path, watching
+// every directory for changes as we go.
+func (s *twoWaySync) scanLocal() (map[string]os.FileInfo, error) {
+	files := map[string]os.FileInfo{}
+	err := filepath.Walk(s.localRoot, func(fullPath string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fullPath == s.localRoot {
+			return s.watcher.Add(fullPath)
+		}
+
+		if syncIgnored(file.Name()) || file.Name() == syncStateName {
+			if file.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		relPath, _ := filepath.Rel(s.localRoot, fullPath)
+		if file.IsDir() {
+			if err := s.watcher.Add(fullPath); err != nil {
+				return err
+			}
+		} else if !file.Mode().IsRegular() {
+			// links and the like have no counterpart on the server
+			return nil
+		}
+
+		files[filepath.ToSlash(relPath)] = file
+		return nil
+	})
+
+	return files, err
+}
+
+// returns everything under the server directory by relative path
+func (s *twoWaySync) scanRemote() (map[string]FileInfoJSON, error) {
+	files := map[string]FileInfoJSON{}
+
+	var scan func(relPath string) error
+	scan = func(relPath string) error {
+		children, err := s.c.list(path.Join(s.remoteRoot, relPath))
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			if syncIgnored(child.Name) || child.Name == syncStateName || child.IsLink {
+				continue
+			}
+
+			childPath := path.Join(relPath, child.Name)
+			files[childPath] = child
+			if child.IsDirectory {
+				if err := scan(childPath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	return files, scan("")
+}
+
+// returns the name a conflicting local copy gets moved to
+func syncConflictPath(localPath string) string {
+	ext := filepath.Ext(localPath)
+	base := strings.TrimSuffix(localPath, ext)
+	return uniquePath(fmt.Sprintf("%s (conflict %s)%s", base, time.Now().Format("2006-01-02 150405"), ext))
+}
+
+// returns whether a local file has the same contents as one on the server.
+// this only reads the local file, comparing it against the server's block
+// signatures.
+func (s *twoWaySync) sameContents(localPath string, remotePath string) (bool, error) {
+	req, err := http.NewRequest("GET", s.c.url("/signatures/", remotePath), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.c.do(req)
+	if err != nil {
+		return false, err
+	}
+	var signature SignatureJSON
+	err = json.NewDecoder(res.Body).Decode(&signature)
+	res.Body.Close()
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	stats, err := writeDelta(bufio.NewReader(f), signature, ioutil.Discard)
+	return err == nil && stats.Unchanged, err
+}
+
+// brings both sides up to date with each other. changes on one side are
+// copied to the other, and when both sides changed the same file the local
+// copy is kept alongside the server's under a new name.
+func (s *twoWaySync) reconcile() error {
+	local, err := s.scanLocal()
+	if err != nil {
+		return err
+	}
+	remote, err := s.scanRemote()
+	if err != nil {
+		return err
+	}
+
+	// look at every path either side knows about, parents before children
+	paths := map[string]bool{}
+	for relPath := range local {
+		paths[relPath] = true
+	}
+	for relPath := range remote {
+		paths[relPath] = true
+	}
+	for relPath := range s.state.Entries {
+		paths[relPath] = true
+	}
+	sorted := []string{}
+	for relPath := range paths {
+		sorted = append(sorted, relPath)
+	}
+	sort.Strings(sorted)
+
+	// directories can only be removed once everything in them is gone, so we
+	// leave them until the end and do the deepest ones first.
+	var removedDirs []func() error
+
+	for _, relPath := range sorted {
+		localPath := filepath.Join(s.localRoot, filepath.FromSlash(relPath))
+		remotePath := path.Join(s.remoteRoot, relPath)
+
+		localFile, inLocal := local[relPath]
+		remoteFile, inRemote := remote[relPath]
+		localNow, remoteNow := "", ""
+		if inLocal {
+			localNow = localSyncVersion(localFile)
+		}
+		if inRemote {
+			remoteNow = remoteSyncVersion(remoteFile)
+		}
+
+		entry := s.state.Entries[relPath]
+		localChanged := localNow != entry.Local
+		remoteChanged := remoteNow != entry.Remote
+
+		// the version of the local file we sent to the server, if we did
+		sentLocal := ""
+
+		var err error
+		switch {
+		case !localChanged && !remoteChanged:
+			continue
+
+		case localNow == "" && remoteNow == "":
+			// gone from both sides, so there's nothing left to remember
+			delete(s.state.Entries, relPath)
+			continue
+
+		case localNow == "dir" && remoteNow == "dir":
+			// directories have no contents of their own to disagree about
+
+		case localChanged && remoteChanged && localNow != "" && remoteNow != "":
+			err = s.resolveConflict(localPath, remotePath, localNow, remoteNow)
+
+		// a change beats a deletion, so a file edited on one side and deleted on
+		// the other comes back rather than being lost.
+		case localChanged && (!remoteChanged || remoteNow == ""):
+			if localNow == "" {
+				if remoteNow == "dir" {
+					removedDirs = append(removedDirs, func() error { return s.removeRemoteDir(remotePath) })
+					continue
+				}
+				log.Printf("Removing %s from the server", remotePath)
+				err = s.c.dav("DELETE", remotePath, nil, nil)
+			} else if localNow == "dir" {
+				err = s.c.mkdir(remotePath)
+			} else {
+				log.Printf("Uploading %s", remotePath)
+				err = s.c.syncFile(localPath, remotePath)
+				sentLocal = localNow
+			}
+
+		default:
+			if remoteNow == "" {
+				if localNow == "dir" {
+					removedDirs = append(removedDirs, func() error { return os.Remove(localPath) })
+					continue
+				}
+				log.Printf("Removing %s", localPath)
+				err = os.Remove(localPath)
+			} else if remoteNow == "dir" {
+				err = os.MkdirAll(localPath, 0755)
+			} else {
+				log.Printf("Downloading %s", remotePath)
+				if err = os.MkdirAll(filepath.Dir(localPath), 0755); err == nil {
+					err = s.c.getFile(remotePath, localPath)
+				}
+			}
+		}
+
+		if err != nil {
+			// leave the state alone so we try again next time
+			log.Printf("Failed to sync %s: %s", relPath, err)
+			continue
+		}
+
+		if err := s.recordSynced(relPath, localPath, remotePath, sentLocal); err != nil {
+			log.Printf("Failed to sync %s: %s", relPath, err)
+		}
+	}
+
+	for i := len(removedDirs) - 1; i >= 0; i-- {
+		if err := removedDirs[i](); err != nil {
+			// anything still in it will be synced back next time
+			log.Printf("Failed to remove directory: %s", err)
+		}
+	}
+
+	return s.saveState()
+}
+
+// remembers what both sides of a path look like now that they agree. if we
+// uploaded the local file, sentLocal is the version of it the server now has.
+// that's what gets remembered rather than how the file looks now, so a change
+// made while it was uploading gets uploaded next time instead of being lost.
+func (s *twoWaySync) recordSynced(relPath string, localPath string, remotePath string, sentLocal string) error {
+	entry := syncEntry{Local: sentLocal}
+	if sentLocal == "" {
+		if file, err := os.Lstat(localPath); err == nil {
+			entry.Local = localSyncVersion(file)
+		}
+	}
+	if file, err := s.c.stat(remotePath); err == nil {
+		entry.Remote = remoteSyncVersion(file)
+	}
+
+	if entry.Local == "" && entry.Remote == "" {
+		delete(s.state.Entries, relPath)
+	} else {
+		s.state.Entries[relPath] = entry
+	}
+	return nil
+}
+
+// removes a directory from the server, but only if it's empty
+func (s *twoWaySync) removeRemoteDir(remotePath string) error {
+	children, err := s.c.list(remotePath)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return fmt.Errorf("%s is not empty", remotePath)
+	}
+
+	log.Printf("Removing %s from the server", remotePath)
+	return s.c.dav("DELETE", remotePath, nil, nil)
+}
+
+// deals with a path that changed on both sides since we last synced it. if
+// they ended up the same there's nothing to do, otherwise the local copy is
+// moved aside and the server's copy takes its place. the moved copy gets
+// uploaded on the next pass like any other new file.
+func (s *twoWaySync) resolveConflict(localPath string, remotePath string, localNow string, remoteNow string) error {
+	if localNow != "dir" && remoteNow != "dir" {
+		same, err := s.sameContents(localPath, remotePath)
+		if err != nil {
+			return err
+		} else if same {
+			return nil
+		}
+	}
+
+	conflictPath := syncConflictPath(localPath)
+	log.Printf("Both copies of %s changed, keeping the local one as %s", remotePath, conflictPath)
+	if err := os.Rename(localPath, conflictPath); err != nil {
+		return err
+	}
+
+	if remoteNow == "dir" {
+		return os.MkdirAll(localPath, 0755)
+	}
+	return s.c.getFile(remotePath, localPath)
+}
+
+// syncs both directions whenever anything changes locally, and checks the
+// server for changes every so often, forever.
+func (s *twoWaySync) run(interval time.Duration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	s.watcher = watcher
+
+	s.loadState()
+	if err := s.reconcile(); err != nil {
+		return err
+	}
+
+	poll := time.NewTicker(interval)
+	defer poll.Stop()
+
+	// wait for local changes to settle rather than syncing halfway through a
+	// file being written.
+	settle := time.NewTimer(syncSettleDelay)
+	settle.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !syncIgnored(filepath.Base(event.Name)) && filepath.Base(event.Name) != syncStateName {
+				settle.Reset(syncSettleDelay)
+			}
+			continue
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Watching for changes failed: %s", err)
+			continue
+
+		case <-settle.C:
+		case <-poll.C:
+		}
+
+		if err := s.reconcile(); err != nil {
+			// the server might just be down for a moment, so keep trying
+			log.Printf("Sync failed: %s", err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// serves memory storage over HTTP for a sync to talk to, counting how many
+// files get sent either way.
+type testSyncServer struct {
+	storage   *memoryStorage
+	url       string
+	transfers int64
+}
+
+func startTestSyncServer(t *testing.T) *testSyncServer {
+	s := &testSyncServer{storage: useMemoryStorage(t)}
+	if err := s.storage.MkdirAll("/bucket/sync"); err != nil {
+		t.Fatal(err)
+	}
+
+	router := newRouter()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isUpload := r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/deltas/")
+		isDownload := r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/files/") && r.Header.Get("Content-Type") != "application/json"
+		if isUpload || isDownload {
+			atomic.AddInt64(&s.transfers, 1)
+		}
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	s.url = server.URL
+
+	return s
+}
+
+// starts syncing a local directory with the server's /sync directory, picking
+// up whatever state a previous sync of it left behind.
+func newTestSync(t *testing.T, server *testSyncServer, localRoot string) *twoWaySync {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { watcher.Close() })
+
+	s := &twoWaySync{
+		c:          &client{server: server.url, quiet: true},
+		localRoot:  localRoot,
+		remoteRoot: "/sync",
+		watcher:    watcher,
+	}
+	s.loadState()
+	return s
+}
+
+func reconcileTest(t *testing.T, s *twoWaySync) {
+	t.Helper()
+	if err := s.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the modification time of the last local file a test wrote
+var testSyncModTime = time.Now().Add(-time.Hour)
+
+// writes a local file, giving it a modification time of its own so the
+// change can't be missed however coarse the file system's clock is.
+func writeTestLocalFile(t *testing.T, name string, data string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testSyncModTime = testSyncModTime.Add(time.Second)
+	if err := os.Chtimes(name, testSyncModTime, testSyncModTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fails unless a local file exists with the given contents
+func expectLocalFile(t *testing.T, name string, data string) {
+	t.Helper()
+	if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != data {
+		t.Errorf("expected %s to contain %q, got %q %v", name, data, contents, err)
+	}
+}
+
+func TestSyncCopiesChangesBothWays(t *testing.T) {
+	server := startTestSyncServer(t)
+	localRoot := t.TempDir()
+	writeTestLocalFile(t, filepath.Join(localRoot, "local.txt"), "from here")
+	writeTestLocalFile(t, filepath.Join(localRoot, "docs", "notes.txt"), "notes")
+	writeTestFile(t, server.storage, "/bucket/sync/remote.txt", []byte("from there"))
+	writeTestFile(t, server.storage, "/bucket/sync/photos/cat.txt", []byte("meow"))
+
+	reconcileTest(t, newTestSync(t, server, localRoot))
+
+	expectTestFile(t, server.storage, "/bucket/sync/local.txt", "from here")
+	expectTestFile(t, server.storage, "/bucket/sync/docs/notes.txt", "notes")
+	expectLocalFile(t, filepath.Join(localRoot, "remote.txt"), "from there")
+	expectLocalFile(t, filepath.Join(localRoot, "photos", "cat.txt"), "meow")
+	if atomic.LoadInt64(&server.transfers) != 4 {
+		t.Errorf("expected 4 files to be sent, got %d", atomic.LoadInt64(&server.transfers))
+	}
+
+	// starting again from the saved state has nothing left to send
+	atomic.StoreInt64(&server.transfers, 0)
+	reconcileTest(t, newTestSync(t, server, localRoot))
+	if atomic.LoadInt64(&server.transfers) != 0 {
+		t.Errorf("expected nothing to be sent after a restart, got %d files", atomic.LoadInt64(&server.transfers))
+	}
+
+	// but changes made while it wasn't running still are
+	writeTestLocalFile(t, filepath.Join(localRoot, "local.txt"), "changed here")
+	writeTestFile(t, server.storage, "/bucket/sync/remote.txt", []byte("changed there"))
+	reconcileTest(t, newTestSync(t, server, localRoot))
+	expectTestFile(t, server.storage, "/bucket/sync/local.txt", "changed here")
+	expectLocalFile(t, filepath.Join(localRoot, "remote.txt"), "changed there")
+	if atomic.LoadInt64(&server.transfers) != 2 {
+		t.Errorf("expected only the 2 changed files to be sent, got %d", atomic.LoadInt64(&server.transfers))
+	}
+}
+
+func TestSyncKeepsConflictingCopies(t *testing.T) {
+	server := startTestSyncServer(t)
+	localRoot := t.TempDir()
+	localPath := filepath.Join(localRoot, "notes.txt")
+	writeTestLocalFile(t, localPath, "original")
+	s := newTestSync(t, server, localRoot)
+	reconcileTest(t, s)
+
+	// the same change on both sides isn't a conflict at all
+	writeTestLocalFile(t, localPath, "the same")
+	writeTestFile(t, server.storage, "/bucket/sync/notes.txt", []byte("the same"))
+	reconcileTest(t, s)
+	if conflicts, _ := filepath.Glob(filepath.Join(localRoot, "notes (conflict *).txt")); len(conflicts) != 0 {
+		t.Fatalf("expected no conflict copies for identical changes, got %v", conflicts)
+	}
+
+	writeTestLocalFile(t, localPath, "changed here")
+	writeTestFile(t, server.storage, "/bucket/sync/notes.txt", []byte("changed there"))
+	reconcileTest(t, s)
+
+	// the server's copy wins, and ours is kept alongside it
+	expectLocalFile(t, localPath, "changed there")
+	expectTestFile(t, server.storage, "/bucket/sync/notes.txt", "changed there")
+	conflicts, _ := filepath.Glob(filepath.Join(localRoot, "notes (conflict *).txt"))
+	if len(conflicts) != 1 {
+		t.Fatalf("expected one conflict copy, got %v", conflicts)
+	}
+	expectLocalFile(t, conflicts[0], "changed here")
+
+	// which gets uploaded like any other new file
+	reconcileTest(t, s)
+	expectTestFile(t, server.storage, "/bucket/sync/"+filepath.Base(conflicts[0]), "changed here")
+}
+
+func TestSyncEditsBeatDeletes(t *testing.T) {
+	server := startTestSyncServer(t)
+	localRoot := t.TempDir()
+	writeTestLocalFile(t, filepath.Join(localRoot, "edited-here.txt"), "original")
+	writeTestLocalFile(t, filepath.Join(localRoot, "edited-there.txt"), "original")
+	s := newTestSync(t, server, localRoot)
+	reconcileTest(t, s)
+
+	writeTestLocalFile(t, filepath.Join(localRoot, "edited-here.txt"), "edited here")
+	if err := server.storage.Remove("/bucket/sync/edited-here.txt"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, server.storage, "/bucket/sync/edited-there.txt", []byte("edited there"))
+	if err := os.Remove(filepath.Join(localRoot, "edited-there.txt")); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTest(t, s)
+
+	expectTestFile(t, server.storage, "/bucket/sync/edited-here.txt", "edited here")
+	expectLocalFile(t, filepath.Join(localRoot, "edited-here.txt"), "edited here")
+	expectTestFile(t, server.storage, "/bucket/sync/edited-there.txt", "edited there")
+	expectLocalFile(t, filepath.Join(localRoot, "edited-there.txt"), "edited there")
+}
+
+func TestSyncRemovesDirectoriesAfterTheirContents(t *testing.T) {
+	server := startTestSyncServer(t)
+	localRoot := t.TempDir()
+	writeTestLocalFile(t, filepath.Join(localRoot, "here", "sub", "a.txt"), "a")
+	writeTestLocalFile(t, filepath.Join(localRoot, "here", "b.txt"), "b")
+	writeTestFile(t, server.storage, "/bucket/sync/there/sub/c.txt", []byte("c"))
+	s := newTestSync(t, server, localRoot)
+	reconcileTest(t, s)
+
+	// remove a whole tree from each side
+	if err := os.RemoveAll(filepath.Join(localRoot, "here")); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeAllStorage(server.storage, "/bucket/sync/there"); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTest(t, s)
+
+	if _, err := server.storage.Lstat("/bucket/sync/here"); !os.IsNotExist(err) {
+		t.Errorf("expected the directory to be removed from the server: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(localRoot, "there")); !os.IsNotExist(err) {
+		t.Errorf("expected the directory to be removed locally: %v", err)
+	}
+
+	// once both sides agree they're gone, there's nothing left to remember
+	reconcileTest(t, s)
+	if len(s.state.Entries) != 0 {
+		t.Errorf("expected nothing left to remember, got %v", s.state.Entries)
+	}
+
+	// a directory with something new in it stays
+	writeTestLocalFile(t, filepath.Join(localRoot, "kept", "old.txt"), "old")
+	reconcileTest(t, s)
+	if err := os.Remove(filepath.Join(localRoot, "kept", "old.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(localRoot, "kept")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, server.storage, "/bucket/sync/kept/new.txt", []byte("new"))
+	reconcileTest(t, s)
+	expectTestFile(t, server.storage, "/bucket/sync/kept/new.txt", "new")
+	expectLocalFile(t, filepath.Join(localRoot, "kept", "new.txt"), "new")
+}
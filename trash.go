@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// whether deleted files are moved to the trash rather than deleted outright
+var TRASH_ENABLED = true
+
+// limits on how long, and how much, the trash keeps. zero means no limit.
+var TRASH_MAX_AGE = 30 * 24 * time.Hour
+var TRASH_MAX_SIZE int64 = 0
+
+// deleted files are moved into a directory with this name at the top of the
+// volume they were on, so deleting never has to copy anything. the one at the
+// top of the root also lists where the other volumes' trash directories are.
+//
+// NOTE: the name starts with tempNamePrefix, so it's hidden along with our
+// temporary files.
+const (
+	trashDirName     = ".bucket-trash"
+	trashVolumesName = "volumes"
+	trashInfoName    = "info.json"
+	trashItemName    = "item"
+)
+
+// guards the list of trash directories
+var trashLock sync.Mutex
+
+type TrashItemJSON struct {
+	ID          string `json:"id"`
+	Path        string `json:"path"` // where it was, relative to the root
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	IsDirectory bool   `json:"is_directory"`
+	DeletedBy   string `json:"deleted_by"`
+	DeletedAt   string `json:"deleted_at"`
+}
+
+// a trashed item, along with where it's kept
+type trashItem struct {
+	TrashItemJSON
+	dir string // the item's own directory in the trash
+}
+
+// returns whether a name is one we keep for ourselves: the trash, and the
+// temporary files things are written to before they're moved into place.
+// these are never listed, and nothing in the trash is reachable except
+// through its endpoints.
+func isReservedName(name string) bool {
+	return strings.HasPrefix(name, tempNamePrefix)
+}
+
+// returns whether a path relative to some directory passes through anything
+// with a reserved name
+func containsReservedName(relPath string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(relPath), "/") {
+		if isReservedName(part) {
+			return true
+		}
+	}
+	return false
+}
+
+type trashDeleterKey struct{}
+
+// records who is responsible for any deletes made with the given context
+func withDeleter(ctx context.Context, deleter string) context.Context {
+	return context.WithValue(ctx, trashDeleterKey{}, deleter)
+}
+
+// returns the address a request came from, without its port
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func deleterFrom(ctx context.Context) string {
+	deleter, _ := ctx.Value(trashDeleterKey{}).(string)
+	return deleter
+}
+
+// returns every trash directory we know about, starting with the root's
+func trashDirs() []string {
+	rootTrash := filepath.Join(ROOT, trashDirName)
+	dirs := []string{rootTrash}
+
+	trashLock.Lock()
+	data, _ := readStorageFile(STORAGE, filepath.Join(rootTrash, trashVolumesName))
+	trashLock.Unlock()
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" && !relPathEscapes(line) {
+			dirs = append(dirs, filepath.Join(ROOT, line, trashDirName))
+		}
+	}
+	return dirs
+}
+
+// remembers that a volume below the root has a trash directory of its own
+func registerTrashVolume(volumePath string) error {
+	relPath, err := filepath.Rel(ROOT, volumePath)
+	if err != nil || relPath == "." {
+		return err
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	trashLock.Lock()
+	defer trashLock.Unlock()
+
+	rootTrash := filepath.Join(ROOT, trashDirName)
+	if err := STORAGE.MkdirAll(rootTrash); err != nil {
+		return err
+	}
+
+	volumesPath := filepath.Join(rootTrash, trashVolumesName)
+	data, _ := readStorageFile(STORAGE, volumesPath)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == relPath {
+			return nil
+		}
+	}
+
+	return writeStorageFile(STORAGE, volumesPath, append(data, relPath+"\n"...))
+}
+
+// returns the total size of a file, or of everything in a directory
+func treeSize(fullPath string) int64 {
+	var size int64
+	walkStorage(STORAGE, fullPath, func(_ string, file os.FileInfo, err error) error {
+		if err == nil && file.Mode().IsRegular() {
+			size += file.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// returns whether an error came from trying to rename across file systems
+func isCrossDevice(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	return ok && linkErr.Err == syscall.EXDEV
+}
+
+// deletes a file or directory under the root, moving it to the trash if the
+// trash is enabled.
+func deletePath(ctx context.Context, fullPath string) error {
+	if fullPath == ROOT {
+		return os.ErrPermission
+	}
+
+	if !TRASH_ENABLED {
+		return removeAllStorage(STORAGE, fullPath)
+	}
+
+	return moveToTrash(fullPath, deleterFrom(ctx))
+}
+
+// moves a file or directory into the trash of the volume it's on. we don't
+// know where volumes start, so we try the trash at the top of the root first
+// and work our way down towards the file until a rename succeeds.
+//
+// NOTE: this only works with files on the local disk, since it relies on
+// renames being cheap within a volume.
+func moveToTrash(fullPath string, deleter string) error {
+	file, err := STORAGE.Lstat(fullPath)
+	if err != nil {
+		return err
+	}
+
+	relPath, err := filepath.Rel(ROOT, fullPath)
+	if err != nil || relPath == "." || relPathEscapes(relPath) {
+		return fmt.Errorf("Invalid path")
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	info, err := json.Marshal(TrashItemJSON{
+		ID:          hex.EncodeToString(id),
+		Path:        filepath.ToSlash(relPath),
+		Name:        file.Name(),
+		Size:        treeSize(fullPath),
+		IsDirectory: file.IsDir(),
+		DeletedBy:   deleter,
+		DeletedAt:   time.Now().UTC().Format("2006-01-02T15:04:05Z"), // ISO 8601
+	})
+	if err != nil {
+		return err
+	}
+
+	// the root, then each directory on the way down to the file's parent
+	volumePath := ROOT
+	parts := strings.Split(filepath.Dir(relPath), string(filepath.Separator))
+	for i := 0; i <= len(parts); i++ {
+		if i > 0 {
+			if parts[i-1] == "." {
+				break
+			}
+			volumePath = filepath.Join(volumePath, parts[i-1])
+		}
+
+		trashPath := filepath.Join(volumePath, trashDirName)
+		_, statErr := STORAGE.Stat(trashPath)
+		created := os.IsNotExist(statErr)
+
+		itemDir := filepath.Join(trashPath, hex.EncodeToString(id))
+		if err = STORAGE.MkdirAll(itemDir); err != nil {
+			return err
+		}
+		err = writeStorageFile(STORAGE, filepath.Join(itemDir, trashInfoName), info)
+		if err == nil {
+			err = STORAGE.Rename(fullPath, filepath.Join(itemDir, trashItemName))
+		}
+		if err == nil {
+			break
+		}
+
+		removeAllStorage(STORAGE, itemDir)
+		if created {
+			STORAGE.Remove(trashPath)
+		}
+		if !isCrossDevice(err) {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if volumePath != ROOT {
+		if err := registerTrashVolume(volumePath); err != nil {
+			log.Printf("Failed to remember the trash in %s: %s", volumePath, err)
+		}
+	}
+
+	// make room if the trash has grown too large
+	go purgeTrash()
+	return nil
+}
+
+// returns everything in the trash, newest first
+func readTrash() []trashItem {
+	items := []trashItem{}
+	for _, trashPath := range trashDirs() {
+		children, err := STORAGE.ReadDir(trashPath)
+		if err != nil {
+			continue
+		}
+
+		for _, child := range children {
+			if !child.IsDir() {
+				continue
+			}
+
+			itemDir := filepath.Join(trashPath, child.Name())
+			data, err := readStorageFile(STORAGE, filepath.Join(itemDir, trashInfoName))
+			if err != nil {
+				continue
+			}
+
+			item := trashItem{dir: itemDir}
+			if json.Unmarshal(data, &item.TrashItemJSON) != nil || item.ID != child.Name() {
+				continue
+			}
+			items = append(items, item)
+		}
+	}
+
+	// timestamps sort the same as strings
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].DeletedAt > items[j].DeletedAt
+	})
+
+	return items
+}
+
+// returns the trashed item with the given ID
+func findTrashItem(id string) (trashItem, bool) {
+	for _, item := range readTrash() {
+		if item.ID == id {
+			return item, true
+		}
+	}
+	return trashItem{}, false
+}
+
+// permanently deletes items that have been in the trash too long, then the
+// oldest items until the trash is small enough.
+func purgeTrash() {
+	var size int64
+	for _, item := range readTrash() {
+		deletedAt, err := time.Parse("2006-01-02T15:04:05Z", item.DeletedAt)
+		tooOld := TRASH_MAX_AGE > 0 && err == nil && time.Since(deletedAt) > TRASH_MAX_AGE
+		tooBig := TRASH_MAX_SIZE > 0 && size+item.Size > TRASH_MAX_SIZE
+		if !tooOld && !tooBig {
+			size += item.Size
+			continue
+		}
+
+		if err := removeAllStorage(STORAGE, item.dir); err != nil {
+			log.Printf("Failed to purge %s from the trash: %s", item.Path, err)
+		}
+	}
+}
+
+// purges old items from the trash, forever
+func cleanupTrash() {
+	for range time.Tick(time.Hour) {
+		purgeTrash()
+	}
+}
+
+// lists everything in the trash, newest first
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	items := []TrashItemJSON{}
+	for _, item := range readTrash() {
+		items = append(items, item.TrashItemJSON)
+	}
+
+	writeJSONResponse(w, items)
+}
+
+// puts an item back where it came from. if something else has taken its place
+// since, the item is restored alongside it under a new name.
+func restoreTrash(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	item, ok := findTrashItem(id)
+	if !ok {
+		http.Error(w, "Could not find "+id+" in the trash", 404)
+		return
+	}
+
+	// the way back might have been replaced by a link to somewhere else since
+	target, err := normalizePathUnderRoot(ROOT, item.Path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// the directory it was in might have been deleted too
+	if err := STORAGE.MkdirAll(filepath.Dir(target)); err != nil {
+		// HTTP 409 - Conflict
+		http.Error(w, "Could not recreate the directory for "+item.Path, 409)
+		return
+	}
+
+	if _, err := STORAGE.Lstat(target); err == nil {
+		target = uniquePath(target)
+	}
+
+	if err := STORAGE.Rename(filepath.Join(item.dir, trashItemName), target); err != nil {
+		http.Error(w, "Could not restore "+item.Path, 500)
+		return
+	}
+	removeAllStorage(STORAGE, item.dir)
+
+	// tell the client where it ended up
+	relPath, _ := filepath.Rel(ROOT, target)
+	item.Path = filepath.ToSlash(relPath)
+	item.Name = filepath.Base(target)
+	writeJSONResponse(w, item.TrashItemJSON)
+}
+
+// permanently deletes an item from the trash
+func purgeTrashItem(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	item, ok := findTrashItem(id)
+	if !ok {
+		http.Error(w, "Could not find "+id+" in the trash", 404)
+		return
+	}
+
+	if err := removeAllStorage(STORAGE, item.dir); err != nil {
+		http.Error(w, "Could not delete "+item.Path, 500)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// permanently deletes everything in the trash
+func emptyTrash(w http.ResponseWriter, r *http.Request) {
+	failed := false
+	for _, item := range readTrash() {
+		if err := removeAllStorage(STORAGE, item.dir); err != nil {
+			log.Printf("Failed to purge %s from the trash: %s", item.Path, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		http.Error(w, "Could not empty the trash", 500)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+// puts a file in the root's trash as though it had been deleted from the
+// given path at the given time
+func writeTestTrashItem(t *testing.T, storage Storage, id string, relPath string, data string, deletedAt time.Time) {
+	t.Helper()
+
+	itemDir := path.Join(ROOT, trashDirName, id)
+	writeTestFile(t, storage, path.Join(itemDir, trashItemName), []byte(data))
+
+	info, err := json.Marshal(TrashItemJSON{
+		ID:        id,
+		Path:      relPath,
+		Name:      path.Base(relPath),
+		Size:      int64(len(data)),
+		DeletedAt: deletedAt.UTC().Format("2006-01-02T15:04:05Z"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStorageFile(storage, path.Join(itemDir, trashInfoName), info); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// returns the IDs of everything in the trash, in order
+func testTrashIDs() []string {
+	ids := []string{}
+	for _, item := range readTrash() {
+		ids = append(ids, item.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestRestoreTrash(t *testing.T) {
+	storage := useMemoryStorage(t)
+	TRASH_ENABLED = true
+	now := time.Now()
+	writeTestTrashItem(t, storage, "01", "docs/notes.txt", "old notes", now)
+	writeTestTrashItem(t, storage, "02", "gone/deeper/file.txt", "in a deleted directory", now)
+	writeTestFile(t, storage, "/bucket/docs/notes.txt", []byte("new notes"))
+
+	var items []TrashItemJSON
+	if code := getTestJSON(t, "/trash/", &items); code != 200 || len(items) != 2 {
+		t.Fatalf("expected both items to be listed, got %d %+v", code, items)
+	}
+
+	tests := []struct {
+		id       string
+		restored string // where the item should end up, relative to the root
+		data     string
+	}{
+		// something else took its place, so it goes alongside it
+		{"01", "docs/notes (2).txt", "old notes"},
+
+		// the directory it was in comes back with it
+		{"02", "gone/deeper/file.txt", "in a deleted directory"},
+	}
+
+	for _, test := range tests {
+		w := serveTestRequest(httptest.NewRequest("POST", "/trash/"+test.id, nil))
+		var item TrashItemJSON
+		if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &item) != nil {
+			t.Fatalf("%s: unexpected response: %d %s", test.id, w.Code, w.Body.String())
+		}
+		if item.Path != test.restored || item.Name != path.Base(test.restored) {
+			t.Errorf("%s: expected to be told it went to %s, got %+v", test.id, test.restored, item)
+		}
+		expectTestFile(t, storage, path.Join(ROOT, test.restored), test.data)
+
+		// it's no longer in the trash, so it can't be restored twice
+		if w := serveTestRequest(httptest.NewRequest("POST", "/trash/"+test.id, nil)); w.Code != 404 {
+			t.Errorf("%s: expected 404 restoring it again, got %d", test.id, w.Code)
+		}
+	}
+
+	// whatever took its place is left alone
+	expectTestFile(t, storage, "/bucket/docs/notes.txt", "new notes")
+	if ids := testTrashIDs(); len(ids) != 0 {
+		t.Errorf("expected the trash to be empty, got %v", ids)
+	}
+}
+
+func TestPurgeTrashItem(t *testing.T) {
+	storage := useMemoryStorage(t)
+	TRASH_ENABLED = true
+	writeTestTrashItem(t, storage, "01", "a.txt", "a", time.Now())
+	writeTestTrashItem(t, storage, "02", "b.txt", "b", time.Now())
+
+	if w := serveTestRequest(httptest.NewRequest("DELETE", "/trash/01", nil)); w.Code != 204 {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	if ids := testTrashIDs(); len(ids) != 1 || ids[0] != "02" {
+		t.Errorf("expected only the other item to be left, got %v", ids)
+	}
+	if _, err := storage.Lstat(path.Join(ROOT, trashDirName, "01")); err == nil {
+		t.Errorf("expected the item to be removed from storage")
+	}
+
+	if w := serveTestRequest(httptest.NewRequest("DELETE", "/trash/01", nil)); w.Code != 404 {
+		t.Errorf("expected 404 purging it again, got %d", w.Code)
+	}
+	if w := serveTestRequest(httptest.NewRequest("POST", "/trash/01", nil)); w.Code != 404 {
+		t.Errorf("expected 404 restoring a purged item, got %d", w.Code)
+	}
+	if _, err := storage.Lstat("/bucket/a.txt"); err == nil {
+		t.Errorf("expected a purged item to stay gone")
+	}
+
+	if w := serveTestRequest(httptest.NewRequest("DELETE", "/trash/", nil)); w.Code != 204 {
+		t.Fatalf("unexpected response emptying the trash: %d %s", w.Code, w.Body.String())
+	}
+	if ids := testTrashIDs(); len(ids) != 0 {
+		t.Errorf("expected the trash to be empty, got %v", ids)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	oldMaxAge, oldMaxSize := TRASH_MAX_AGE, TRASH_MAX_SIZE
+	t.Cleanup(func() { TRASH_MAX_AGE, TRASH_MAX_SIZE = oldMaxAge, oldMaxSize })
+
+	now := time.Now()
+	tests := []struct {
+		maxAge  time.Duration
+		maxSize int64
+		kept    []string
+	}{
+		{0, 0, []string{"new", "old", "older"}},
+
+		// anything deleted too long ago goes
+		{36 * time.Hour, 0, []string{"new", "old"}},
+		{time.Hour, 0, []string{"new"}},
+
+		// then the oldest items until everything left fits
+		{0, 1000, []string{"new", "old", "older"}},
+		{0, 300, []string{"new", "old"}},
+		{0, 299, []string{"new"}},
+		{0, 99, []string{}},
+		{time.Hour, 1000, []string{"new"}},
+	}
+
+	for _, test := range tests {
+		storage := useMemoryStorage(t)
+		TRASH_ENABLED = true
+		writeTestTrashItem(t, storage, "new", "new.txt", string(make([]byte, 100)), now)
+		writeTestTrashItem(t, storage, "old", "old.txt", string(make([]byte, 200)), now.Add(-24*time.Hour))
+		writeTestTrashItem(t, storage, "older", "older.txt", string(make([]byte, 300)), now.Add(-48*time.Hour))
+
+		TRASH_MAX_AGE = test.maxAge
+		TRASH_MAX_SIZE = test.maxSize
+		purgeTrash()
+
+		kept := testTrashIDs()
+		if len(kept) != len(test.kept) {
+			t.Errorf("age %s, size %d: expected %v to be kept, got %v", test.maxAge, test.maxSize, test.kept, kept)
+			continue
+		}
+		for i := range kept {
+			if kept[i] != test.kept[i] {
+				t.Errorf("age %s, size %d: expected %v to be kept, got %v", test.maxAge, test.maxSize, test.kept, kept)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// the directory previous versions of overwritten files are kept in, outside
+// the root so they never show up in listings. versioning is disabled if empty.
+var VERSIONS_ROOT = ""
+
+// how many versions of a file to keep, and for how long. zero means no limit.
+var MAX_VERSIONS = 20
+var MAX_VERSION_AGE = 30 * 24 * time.Hour
+
+// the file in each path's version directory recording which path it's for
+const versionPathName = "path"
+
+type VersionJSON struct {
+	ID         string `json:"id"`
+	Size       int64  `json:"size"`
+	ModifiedAt string `json:"modified_at"` // when the version was last modified
+	SavedAt    string `json:"saved_at"`    // when it was replaced
+}
+
+// returns the directory the versions of a file under the root are kept in.
+// paths are hashed so deep or odd names can't collide with each other.
+func versionsDir(filePath string) (string, error) {
+	relPath, err := filepath.Rel(ROOT, filePath)
+	if err != nil || relPathEscapes(relPath) {
+		return "", fmt.Errorf("Invalid path")
+	}
+
+	sum := sha1.Sum([]byte(filepath.ToSlash(relPath)))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(VERSIONS_ROOT, key[:2], key), nil
+}
+
+// returns the versions in a version directory, newest first
+func readVersions(dir string) ([]os.FileInfo, error) {
+	children, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []os.FileInfo{}
+	for _, child := range children {
+		if _, err := strconv.ParseInt(child.Name(), 10, 64); err == nil && child.Mode().IsRegular() {
+			versions = append(versions, child)
+		}
+	}
+
+	// IDs are the times versions were saved, so the longest is the newest
+	sort.Slice(versions, func(i, j int) bool {
+		a, b := versions[i].Name(), versions[j].Name()
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a > b
+	})
+
+	return versions, nil
+}
+
+// returns when a version was saved, given its ID
+func versionSavedAt(id string) time.Time {
+	nanos, _ := strconv.ParseInt(id, 10, 64)
+	return time.Unix(0, nanos)
+}
+
+// keeps a copy of a file that's about to be overwritten. does nothing if the
+// file doesn't exist or isn't a regular file. callers should refuse to
+// overwrite the file if this fails, since its contents would be lost.
+func saveVersion(filePath string) error {
+	if VERSIONS_ROOT == "" {
+		return nil
+	}
+
+	file, err := STORAGE.Lstat(filePath)
+	if err != nil || !file.Mode().IsRegular() {
+		return nil
+	}
+
+	dir, err := versionsDir(filePath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	relPath, _ := filepath.Rel(ROOT, filePath)
+	if err := ioutil.WriteFile(filepath.Join(dir, versionPathName), []byte(filepath.ToSlash(relPath)), 0644); err != nil {
+		return err
+	}
+
+	src, err := STORAGE.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := ioutil.TempFile(dir, ".version")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(f.Name(), file.ModTime(), file.ModTime())
+	}
+
+	// find an unused ID, in case two versions get saved at the same moment
+	if err == nil {
+		id := time.Now().UnixNano()
+		for {
+			versionPath := filepath.Join(dir, strconv.FormatInt(id, 10))
+			if _, statErr := os.Lstat(versionPath); os.IsNotExist(statErr) {
+				err = os.Rename(f.Name(), versionPath)
+				break
+			}
+			id++
+		}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	pruneVersions(dir)
+	return nil
+}
+
+// removes versions beyond our limits from a version directory, and the
+// directory itself once it's empty.
+func pruneVersions(dir string) {
+	versions, err := readVersions(dir)
+	if err != nil {
+		return
+	}
+
+	kept := 0
+	for i, version := range versions {
+		tooMany := MAX_VERSIONS > 0 && i >= MAX_VERSIONS
+		tooOld := MAX_VERSION_AGE > 0 && time.Since(versionSavedAt(version.Name())) > MAX_VERSION_AGE
+		if !tooMany && !tooOld {
+			kept++
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, version.Name())); err != nil {
+			log.Printf("Failed to remove old version %s: %s", version.Name(), err)
+			kept++
+		}
+	}
+
+	if kept == 0 {
+		os.RemoveAll(dir)
+	}
+}
+
+// removes versions that have outlived their welcome, forever
+func cleanupVersions() {
+	for range time.Tick(time.Hour) {
+		prefixes, err := ioutil.ReadDir(VERSIONS_ROOT)
+		if err != nil {
+			continue
+		}
+
+		for _, prefix := range prefixes {
+			prefixPath := filepath.Join(VERSIONS_ROOT, prefix.Name())
+			dirs, err := ioutil.ReadDir(prefixPath)
+			if err != nil {
+				continue
+			}
+
+			for _, dir := range dirs {
+				pruneVersions(filepath.Join(prefixPath, dir.Name()))
+			}
+		}
+	}
+}
+
+// returns the full path to the requested version of a file, or an error
+// suitable for the client if there's no such version.
+func findVersion(filePath string, rawPath string, id string) (string, os.FileInfo, error) {
+	dir, err := versionsDir(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// IDs are always plain numbers, which also keeps them inside the directory
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return "", nil, fmt.Errorf("Invalid version: %s", id)
+	}
+
+	versionPath := filepath.Join(dir, id)
+	version, err := os.Lstat(versionPath)
+	if err != nil || !version.Mode().IsRegular() {
+		return "", nil, fmt.Errorf("Could not find version %s of %s", id, rawPath)
+	}
+
+	return versionPath, version, nil
+}
+
+// lists the previous versions of a file, newest first, or downloads one of
+// them if given its `id`.
+func getVersions(w http.ResponseWriter, r *http.Request) {
+	rawPath := mux.Vars(r)["path"]
+	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if VERSIONS_ROOT == "" {
+		http.Error(w, "Versioning is disabled", 404)
+		return
+	}
+
+	if id := r.URL.Query().Get("id"); id != "" {
+		downloadVersion(w, r, normalizedPath, rawPath, id)
+		return
+	}
+
+	dir, err := versionsDir(normalizedPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// a file that was never overwritten simply has no versions
+	versions, err := readVersions(dir)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Could not read the versions of "+rawPath, 500)
+		return
+	}
+
+	result := []VersionJSON{}
+	for _, version := range versions {
+		result = append(result, VersionJSON{
+			version.Name(),
+			version.Size(),
+			version.ModTime().Format("2006-01-02T15:04:05Z"),              // ISO 8601
+			versionSavedAt(version.Name()).Format("2006-01-02T15:04:05Z"), // ISO 8601
+		})
+	}
+
+	writeJSONResponse(w, result)
+}
+
+func downloadVersion(w http.ResponseWriter, r *http.Request, filePath string, rawPath string, id string) {
+	versionPath, version, err := findVersion(filePath, rawPath, id)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	name := filepath.Base(filePath)
+	if !setContentDisposition(w, r, name, dispositionAttachment) {
+		return
+	}
+
+	f, err := os.Open(versionPath)
+	if err != nil {
+		http.Error(w, "Could not open version "+id+" of "+rawPath, 500)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Add("Content-Type", getMIMEType(name))
+	http.ServeContent(w, r, name, version.ModTime(), f)
+}
+
+// replaces a file with one of its previous versions, given by `id`. the
+// file's current contents become a version of their own, so a restore can
+// always be undone.
+func restoreVersion(w http.ResponseWriter, r *http.Request) {
+	rawPath := mux.Vars(r)["path"]
+	normalizedPath, err := normalizePathUnderRoot(ROOT, rawPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if VERSIONS_ROOT == "" {
+		http.Error(w, "Versioning is disabled", 404)
+		return
+	}
+
+	versionPath, _, err := findVersion(normalizedPath, rawPath, r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	if file, err := STORAGE.Lstat(normalizedPath); err == nil && !file.Mode().IsRegular() {
+		// HTTP 409 - Conflict
+		http.Error(w, rawPath+" is not a regular file", 409)
+		return
+	}
+
+	parent, err := STORAGE.Stat(filepath.Dir(normalizedPath))
+	if err != nil || !parent.IsDir() {
+		http.Error(w, "Could not find the directory for "+rawPath, 404)
+		return
+	}
+
+	src, err := os.Open(versionPath)
+	if err != nil {
+		http.Error(w, "Could not read the version of "+rawPath, 500)
+		return
+	}
+	defer src.Close()
+
+	// copy the version next to the file first so it's replaced in one go
+	tempPath := tempPathIn(filepath.Dir(normalizedPath), "version")
+	f, err := STORAGE.Create(tempPath)
+	if err != nil {
+		http.Error(w, "Could not restore "+rawPath, 500)
+		return
+	}
+	_, err = io.Copy(f, src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = saveVersion(normalizedPath)
+	}
+	if err == nil {
+		err = STORAGE.Rename(tempPath, normalizedPath)
+	}
+	if err != nil {
+		STORAGE.Remove(tempPath)
+		http.Error(w, "Could not restore "+rawPath, 500)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}